@@ -0,0 +1,299 @@
+package toolkit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	defaultMaxArchiveEntries = 1000
+	defaultMaxArchiveSize    = 1 << 30
+	defaultMaxArchiveRatio   = 100
+	// archiveRatioThreshold is how much an archive may expand before its compression ratio is checked,
+	// so small, very compressible files are not mistaken for bombs
+	archiveRatioThreshold = 1 << 20
+)
+
+// ErrUnsafeArchive is returned when an uploaded archive has an entry that escapes the upload directory,
+// a link, or goes over the limits in ArchiveOptions
+var ErrUnsafeArchive = errors.New("the uploaded archive is unsafe")
+
+// ArchiveOptions configures the extraction of uploaded zip, tar and tar.gz archives. Each entry is saved
+// like an uploaded file of its own, so it is checked against AllowedFileTypes, MaxFileSize, Scanner and
+// the quotas, and it counts towards MaxUploadSize. Entries keep their name and directory under the upload
+// directory, whatever the rename argument, but never replace a stored file: with CollisionOverwrite they
+// get a suffix like CollisionSuffix gives. The archive itself is saved as well. Archives inside archives
+// are not extracted
+type ArchiveOptions struct {
+	// MaxEntries is the most files an archive may hold. It defaults to 1000
+	MaxEntries int
+	// MaxSize is the largest size, in bytes, of all the files of an archive once extracted. It defaults to 1GB
+	MaxSize int64
+	// MaxRatio is the largest ratio between the extracted and the compressed size of an archive, checked
+	// once it expands to more than 1MB. It defaults to 100
+	MaxRatio float64
+}
+
+// isArchive reports whether the detected type is an archive format ArchiveOptions applies to
+func isArchive(mimeType string) bool {
+	switch mimeType {
+	case "application/zip", "application/x-tar", "application/gzip":
+		return true
+	}
+	return false
+}
+
+// archive is the state of the extraction of one archive
+type archive struct {
+	u    *upload
+	file *UploadedFile
+	opts ArchiveOptions
+	// compressed returns how many compressed bytes were read so far, and expanded is how many bytes the
+	// entries extracted so far add up to
+	compressed func() int64
+	expanded   int64
+	entries    int
+}
+
+// extractArchive saves the entries of the archive saved under key in the upload directory, adding them to
+// the Extracted files of uploadedFile
+func (u *upload) extractArchive(key string, uploadedFile *UploadedFile) error {
+	if u.extracting {
+		return nil
+	}
+	u.extracting = true
+	defer func() { u.extracting = false }()
+
+	opts := *u.t.Archives
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaultMaxArchiveEntries
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultMaxArchiveSize
+	}
+	if opts.MaxRatio <= 0 {
+		opts.MaxRatio = defaultMaxArchiveRatio
+	}
+
+	a := &archive{u: u, file: uploadedFile, opts: opts}
+
+	obj, err := u.t.storage().Get(key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	switch uploadedFile.DetectedType {
+	case "application/zip":
+		return a.extractZip(obj, uploadedFile.FileSize)
+	case "application/gzip":
+		counter := &countingReader{r: obj}
+		gz, err := gzip.NewReader(counter)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrUnsafeArchive, err)
+		}
+		defer gz.Close()
+		a.compressed = func() int64 { return counter.n }
+		return a.extractTar(gz, true)
+	default:
+		return a.extractTar(obj, false)
+	}
+}
+
+func (a *archive) extractZip(obj io.Reader, size int64) error {
+	ra, ok := obj.(io.ReaderAt)
+	if !ok {
+		// zip needs random access, so storages that stream are spooled to a temporary file
+		tmp, err := os.CreateTemp("", "toolkit-archive-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if size, err = io.Copy(tmp, obj); err != nil {
+			return err
+		}
+		ra = tmp
+	}
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnsafeArchive, err)
+	}
+
+	// the declared sizes are checked before anything is extracted, and the actual ones as entries are read
+	var declared uint64
+	for _, f := range zr.File {
+		declared += f.UncompressedSize64
+	}
+	if len(zr.File) > a.opts.MaxEntries {
+		return fmt.Errorf("%w: more than %d entries", ErrUnsafeArchive, a.opts.MaxEntries)
+	}
+	if declared > uint64(a.opts.MaxSize) {
+		return fmt.Errorf("%w: expands to more than %d bytes", ErrUnsafeArchive, a.opts.MaxSize)
+	}
+
+	var compressed int64
+	a.compressed = func() int64 { return compressed }
+
+	for _, f := range zr.File {
+		if f.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %q is a link", ErrUnsafeArchive, f.Name)
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		compressed += int64(f.CompressedSize64)
+
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrUnsafeArchive, err)
+		}
+		err = a.extractEntry(f.Name, rc, int64(f.UncompressedSize64))
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *archive) extractTar(r io.Reader, compressed bool) error {
+	tr := tar.NewReader(r)
+
+	if !compressed {
+		// a plain tar is not compressed, so its ratio is always one
+		a.compressed = func() int64 { return a.expanded }
+	}
+
+	for first := true; ; first = false {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && first && compressed {
+			// a gzip file that does not hold a tar archive is kept as it is
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrUnsafeArchive, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+		case tar.TypeDir:
+			continue
+		case tar.TypeSymlink, tar.TypeLink:
+			return fmt.Errorf("%w: %q is a link", ErrUnsafeArchive, header.Name)
+		default:
+			// devices, fifos and the like are not files anyone uploads on purpose
+			continue
+		}
+
+		if err := a.extractEntry(header.Name, tr, header.Size); err != nil {
+			return err
+		}
+	}
+}
+
+// extractEntry saves the file named name read from r, checking it stays under the upload directory and
+// within the limits of the archive
+func (a *archive) extractEntry(name string, r io.Reader, declared int64) error {
+	u := a.u
+
+	a.entries++
+	if a.entries > a.opts.MaxEntries {
+		return fmt.Errorf("%w: more than %d entries", ErrUnsafeArchive, a.opts.MaxEntries)
+	}
+
+	name = strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(name) || strings.HasPrefix(name, "//") {
+		return fmt.Errorf("%w: %q is an absolute path", ErrUnsafeArchive, name)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return fmt.Errorf("%w: %q escapes the upload directory", ErrUnsafeArchive, name)
+		}
+	}
+
+	dir, base := path.Split(path.Clean(name))
+
+	entryDir := u.uploadDir
+	for _, segment := range strings.Split(dir, "/") {
+		if segment == "" || segment == "." {
+			continue
+		}
+		safe, err := u.t.SanitizeFileName(segment)
+		if err != nil {
+			return fmt.Errorf("%w: %q: %s", ErrUnsafeArchive, name, err)
+		}
+		entryDir = storageKey(entryDir, safe)
+	}
+
+	uploadDir, renameFile := u.uploadDir, u.renameFile
+	u.uploadDir, u.renameFile = entryDir, false
+	defer func() { u.uploadDir, u.renameFile = uploadDir, renameFile }()
+
+	extracted, err := u.saveFile(&archiveEntryReader{r: r, a: a, name: name, declared: declared}, a.file.FieldName, base, textproto.MIMEHeader{})
+	if err != nil {
+		return err
+	}
+
+	a.file.Extracted = append(a.file.Extracted, extracted)
+	return nil
+}
+
+// archiveEntryReader reads an archive entry, failing as soon as it is bigger than it declared or the
+// archive goes over its limits
+type archiveEntryReader struct {
+	r        io.Reader
+	a        *archive
+	name     string
+	declared int64
+	n        int64
+}
+
+func (e *archiveEntryReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.n += int64(n)
+	e.a.expanded += int64(n)
+
+	opts := e.a.opts
+
+	if e.n > e.declared {
+		return n, fmt.Errorf("%w: %q is bigger than it declares", ErrUnsafeArchive, e.name)
+	}
+
+	if e.a.expanded > opts.MaxSize {
+		return n, fmt.Errorf("%w: expands to more than %d bytes", ErrUnsafeArchive, opts.MaxSize)
+	}
+
+	if e.a.expanded > archiveRatioThreshold && float64(e.a.expanded) > opts.MaxRatio*float64(e.a.compressed()) {
+		return n, fmt.Errorf("%w: compression ratio over %g", ErrUnsafeArchive, opts.MaxRatio)
+	}
+
+	return n, err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
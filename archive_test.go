@@ -0,0 +1,173 @@
+package toolkit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+)
+
+type testEntry struct {
+	name    string
+	content []byte
+	link    bool
+}
+
+func testZipArchive(t *testing.T, entries ...testEntry) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	for _, entry := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: entry.name, Method: zip.Deflate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(entry.content)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testTarGz(t *testing.T, entries ...testEntry) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.content)), Typeflag: tar.TypeReg}
+		if entry.link {
+			header = &tar.Header{Name: entry.name, Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(entry.content)
+	}
+
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestTools_UploadFilesArchives(t *testing.T) {
+	zipArchive := testZipArchive(t,
+		testEntry{name: "readme.txt", content: []byte("read me")},
+		testEntry{name: "docs/", content: nil},
+		testEntry{name: "docs/guide.txt", content: []byte("a guide")},
+	)
+	tarGz := testTarGz(t,
+		testEntry{name: "readme.txt", content: []byte("read me")},
+		testEntry{name: "docs/guide.txt", content: []byte("a guide")},
+	)
+
+	for name, content := range map[string][]byte{"bundle.zip": zipArchive, "bundle.tar.gz": tarGz} {
+		var store MemoryStorage
+		testTools := Tools{Storage: &store, Archives: &ArchiveOptions{}}
+
+		uploadedFiles, err := testTools.UploadFilesStream(newUploadRequest(t, testPart{field: "file", fileName: name, content: content}), "uploads")
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		extracted := uploadedFiles[0].Extracted
+		if len(extracted) != 2 || extracted[0].Key != "uploads/readme.txt" || extracted[1].Key != "uploads/docs/guide.txt" {
+			t.Fatalf("%s: wrong extracted files: %+v", name, extracted)
+		}
+
+		if extracted[1].OriginalFileName != "guide.txt" || extracted[1].FileSize != 7 {
+			t.Errorf("%s: wrong extracted file: %+v", name, extracted[1])
+		}
+
+		if _, err := store.Stat("uploads/docs/guide.txt"); err != nil {
+			t.Errorf("%s: extracted file not saved: %s", name, err)
+		}
+	}
+}
+
+func TestTools_UploadFilesUnsafeArchives(t *testing.T) {
+	bomb := testZipArchive(t, testEntry{name: "zeros.txt", content: bytes.Repeat([]byte{'0'}, 5<<20)})
+
+	var unsafeArchiveTests = []struct {
+		name    string
+		content []byte
+		options ArchiveOptions
+	}{
+		{name: "zip slip", content: testZipArchive(t, testEntry{name: "ok.txt", content: []byte("fine")}, testEntry{name: "../evil.txt", content: []byte("evil")})},
+		{name: "absolute path", content: testTarGz(t, testEntry{name: "/etc/cron.d/evil", content: []byte("evil")})},
+		{name: "windows slip", content: testZipArchive(t, testEntry{name: `..\evil.txt`, content: []byte("evil")})},
+		{name: "symlink", content: testTarGz(t, testEntry{name: "passwd", link: true})},
+		{name: "too many entries", content: testZipArchive(t, testEntry{name: "a.txt"}, testEntry{name: "b.txt"}, testEntry{name: "c.txt"}), options: ArchiveOptions{MaxEntries: 2}},
+		{name: "too big", content: testTarGz(t, testEntry{name: "a.txt", content: bytes.Repeat([]byte("a"), 2000)}), options: ArchiveOptions{MaxSize: 1000}},
+		{name: "compression ratio", content: bomb},
+	}
+
+	for _, entry := range unsafeArchiveTests {
+		var store MemoryStorage
+		options := entry.options
+		testTools := Tools{Storage: &store, Archives: &options}
+
+		_, err := testTools.UploadFilesStream(newUploadRequest(t, testPart{field: "file", fileName: "bundle", content: entry.content}), "uploads")
+		if !errors.Is(err, ErrUnsafeArchive) {
+			t.Errorf("%s: expected ErrUnsafeArchive, but got %v", entry.name, err)
+		}
+
+		if saved, _ := store.List(""); len(saved) != 0 {
+			t.Errorf("%s: expected nothing to be left, but found %+v", entry.name, saved)
+		}
+	}
+
+	// a gzip file that is not a tar archive is saved as it is
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte("just a compressed log"))
+	gz.Close()
+
+	testTools := Tools{Storage: &MemoryStorage{}, Archives: &ArchiveOptions{}}
+	uploadedFiles, err := testTools.UploadFilesStream(newUploadRequest(t, testPart{field: "file", fileName: "app.log.gz", content: buf.Bytes()}), "uploads")
+	if err != nil || len(uploadedFiles[0].Extracted) != 0 {
+		t.Errorf("expected a plain gzip file to be kept as it is, but got %v", err)
+	}
+}
+
+func TestTools_UploadFilesArchiveKeepsStoredFiles(t *testing.T) {
+	var store MemoryStorage
+	testTools := Tools{Storage: &store, Archives: &ArchiveOptions{}}
+
+	if _, err := store.Put("up/victim.txt", bytes.NewReader([]byte("stored"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// an archive that fails after an entry named like the stored file must not take it along
+	failing := testZipArchive(t, testEntry{name: "victim.txt", content: []byte("evil")}, testEntry{name: "../evil.txt", content: []byte("evil")})
+	if _, err := testTools.UploadFiles(newUploadRequest(t, testPart{field: "file", fileName: "bundle.zip", content: failing}), "up", true); !errors.Is(err, ErrUnsafeArchive) {
+		t.Fatalf("expected ErrUnsafeArchive, but got %v", err)
+	}
+
+	if saved, _ := store.List("up/"); len(saved) != 1 || saved[0].Key != "up/victim.txt" || saved[0].Size != int64(len("stored")) {
+		t.Fatalf("expected only the stored file to be left as it was, but found %+v", saved)
+	}
+
+	// an archive that succeeds saves the entry next to the stored file
+	archive := testZipArchive(t, testEntry{name: "victim.txt", content: []byte("new")})
+	uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testPart{field: "file", fileName: "bundle.zip", content: archive}), "up", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if extracted := uploadedFiles[0].Extracted; len(extracted) != 1 || extracted[0].Key != "up/victim-1.txt" {
+		t.Errorf("expected the entry to get a suffix, but got %+v", extracted)
+	}
+
+	if info, err := store.Stat("up/victim.txt"); err != nil || info.Size != int64(len("stored")) {
+		t.Errorf("expected the stored file to be kept, but got %+v, %v", info, err)
+	}
+}
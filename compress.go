@@ -0,0 +1,257 @@
+package toolkit
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const defaultMinCompressSize = 1024
+
+// CompressionOptions configures the gzip and deflate compression of responses, for the clients that ask
+// for it with Accept-Encoding. Only types that compress well, such as text, JSON, XML and JavaScript,
+// are compressed, and never byte ranges
+type CompressionOptions struct {
+	// MinSize is the smallest body, in bytes, that is compressed, as compressing small ones costs more
+	// than it saves. It defaults to 1KB
+	MinSize int
+	// Level is the gzip or deflate compression level, from 1 to 9. Zero uses the default level
+	Level int
+}
+
+// CompressHandler compresses the responses of next, such as the ones written by WriteJSON and ErrorJSON,
+// following Compression. When Compression is nil, next is returned as it is
+func (t *Tools) CompressHandler(next http.Handler) http.Handler {
+	if t.Compression == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw, done := t.compressResponse(w, r)
+		defer done()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressResponse returns a writer that compresses the response to r written to it when Compression
+// allows, and a function to call once the response is written
+func (t *Tools) compressResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if t.Compression == nil {
+		return w, func() {}
+	}
+
+	addVary(w.Header(), "Accept-Encoding")
+
+	encoding := acceptedEncoding(r, "gzip", "deflate")
+	if encoding == "" || r.Header.Get("Range") != "" {
+		return w, func() {}
+	}
+
+	cw := &compressWriter{ResponseWriter: w, r: r, encoding: encoding, opts: *t.Compression}
+	return cw, func() { cw.Close() }
+}
+
+// acceptedEncoding returns the first of encodings that the Accept-Encoding header of r accepts with the
+// highest quality, or an empty string when it accepts none
+func acceptedEncoding(r *http.Request, encodings ...string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qualities[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+func addVary(h http.Header, field string) {
+	for _, value := range h.Values("Vary") {
+		for _, existing := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+// compressibleType reports whether contentType is worth compressing
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-javascript",
+		"application/ecmascript", "application/wasm", "application/x-ndjson", "image/bmp", "image/x-icon":
+		return true
+	}
+	return false
+}
+
+// compressWriter compresses what is written to it, once the headers show the response is worth it
+type compressWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	encoding string
+	opts     CompressionOptions
+	// w is where the body goes once the headers are written, compressed or not
+	w           io.Writer
+	compressing io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.w != nil {
+		return
+	}
+	c.w = c.ResponseWriter
+
+	h := c.Header()
+	if c.worthCompressing(status) {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+
+		// the compressed body is another representation, so it cannot keep a strong ETag
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+
+		if c.r.Method != http.MethodHead {
+			level := c.opts.Level
+			if level < gzip.BestSpeed || level > gzip.BestCompression {
+				level = gzip.DefaultCompression
+			}
+
+			// with a valid level, neither writer can fail
+			if c.encoding == "gzip" {
+				c.compressing, _ = gzip.NewWriterLevel(c.ResponseWriter, level)
+			} else {
+				c.compressing, _ = flate.NewWriter(c.ResponseWriter, level)
+			}
+			c.w = c.compressing
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) worthCompressing(status int) bool {
+	h := c.Header()
+
+	if status != http.StatusOK || h.Get("Content-Encoding") != "" || !compressibleType(h.Get("Content-Type")) {
+		return false
+	}
+
+	minSize := c.opts.MinSize
+	if minSize <= 0 {
+		minSize = defaultMinCompressSize
+	}
+
+	// a body of unknown length is assumed to be big enough
+	if length := h.Get("Content-Length"); length != "" {
+		if size, err := strconv.Atoi(length); err == nil && size < minSize {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.w == nil {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.w.Write(p)
+}
+
+func (c *compressWriter) Flush() {
+	if f, ok := c.compressing.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *compressWriter) Close() error {
+	if c.compressing == nil {
+		return nil
+	}
+	return c.compressing.Close()
+}
+
+// serveGzipSibling serves the file name+".gz" in fsys in place of name, when Compression is set, the
+// client accepts gzip and the file exists. It reports whether it did
+func (t *Tools) serveGzipSibling(w http.ResponseWriter, r *http.Request, fsys fs.FS, name, displayName string) bool {
+	if t.Compression == nil || acceptedEncoding(r, "gzip") == "" {
+		return false
+	}
+
+	f, err := fsys.Open(name + ".gz")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+
+	addVary(w.Header(), "Accept-Encoding")
+	w.Header().Set("Content-Encoding", "gzip")
+	if mime.TypeByExtension(path.Ext(name)) == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	t.setContentDisposition(w, displayName)
+
+	// the type is the one of the file, not of its compressed copy
+	serveContent(w, r, name, info.ModTime(), content, fileETag(info.Size(), info.ModTime()))
+	return true
+}
@@ -0,0 +1,147 @@
+package toolkit
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTools_CompressHandler(t *testing.T) {
+	testTools := Tools{Compression: &CompressionOptions{MinSize: 100}}
+
+	big := map[string]string{"message": strings.Repeat("compress me ", 50)}
+	small := map[string]string{"message": "hi"}
+
+	var compressTests = []struct {
+		name             string
+		acceptEncoding   string
+		data             interface{}
+		expectedEncoding string
+	}{
+		{name: "gzip", acceptEncoding: "gzip, deflate", data: big, expectedEncoding: "gzip"},
+		{name: "deflate", acceptEncoding: "deflate", data: big, expectedEncoding: "deflate"},
+		{name: "preferred", acceptEncoding: "gzip;q=0.5, deflate", data: big, expectedEncoding: "deflate"},
+		{name: "any", acceptEncoding: "*", data: big, expectedEncoding: "gzip"},
+		{name: "refused", acceptEncoding: "gzip;q=0", data: big},
+		{name: "unsupported", acceptEncoding: "br", data: big},
+		{name: "none", data: big},
+		{name: "small", acceptEncoding: "gzip", data: small},
+	}
+
+	for _, entry := range compressTests {
+		handler := testTools.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = testTools.WriteJSON(w, http.StatusOK, entry.data)
+		}))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		if entry.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", entry.acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Header().Get("Content-Encoding") != entry.expectedEncoding {
+			t.Errorf("%s: expected encoding %q, but got %q", entry.name, entry.expectedEncoding, rr.Header().Get("Content-Encoding"))
+		}
+		if rr.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: expected Vary: Accept-Encoding, but got %q", entry.name, rr.Header().Get("Vary"))
+		}
+
+		var body io.Reader = rr.Body
+		switch entry.expectedEncoding {
+		case "gzip":
+			gz, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatalf("%s: %s", entry.name, err)
+			}
+			body = gz
+		case "deflate":
+			body = flate.NewReader(rr.Body)
+		default:
+			if rr.Header().Get("Content-Length") == "" {
+				t.Errorf("%s: expected a Content-Length", entry.name)
+			}
+		}
+
+		content, err := io.ReadAll(body)
+		if err != nil || !strings.Contains(string(content), `"message"`) {
+			t.Errorf("%s: wrong body %q: %v", entry.name, content, err)
+		}
+	}
+}
+
+func TestTools_DownloadCompressed(t *testing.T) {
+	testTools := Tools{Compression: &CompressionOptions{}}
+
+	dir := t.TempDir()
+	text := strings.Repeat("some text to compress\n", 200)
+	_ = os.WriteFile(filepath.Join(dir, "plain.txt"), []byte(text), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "static.css"), []byte("body { color: red }"), 0644)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte("body { color: blue }"))
+	_ = gw.Close()
+	_ = os.WriteFile(filepath.Join(dir, "static.css.gz"), gz.Bytes(), 0644)
+
+	download := func(fileName string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rr := httptest.NewRecorder()
+		testTools.DownloadStaticFile(rr, req, dir, fileName, fileName)
+		return rr
+	}
+
+	// compressed on the fly
+	rr := download("plain.txt", map[string]string{"Accept-Encoding": "gzip"})
+	if rr.Header().Get("Content-Encoding") != "gzip" || rr.Header().Get("Accept-Ranges") != "" {
+		t.Fatalf("wrong headers: %v", rr.Header())
+	}
+	gr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := io.ReadAll(gr); string(content) != text {
+		t.Error("the compressed body does not match the file")
+	}
+
+	// ranges are never compressed
+	rr = download("plain.txt", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-3"})
+	if rr.Code != http.StatusPartialContent || rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != "some" {
+		t.Errorf("wrong range response: %d %v %q", rr.Code, rr.Header(), rr.Body.String())
+	}
+
+	// the pre-compressed copy is preferred
+	rr = download("static.css", map[string]string{"Accept-Encoding": "gzip"})
+	if rr.Header().Get("Content-Encoding") != "gzip" || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/css") || rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("wrong headers: %v", rr.Header())
+	}
+	if !bytes.Equal(rr.Body.Bytes(), gz.Bytes()) {
+		t.Error("expected the pre-compressed copy to be sent")
+	}
+
+	// and the file itself goes to the clients that do not accept gzip
+	rr = download("static.css", nil)
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != "body { color: red }" {
+		t.Errorf("wrong uncompressed response: %v %q", rr.Header(), rr.Body.String())
+	}
+
+	// compressed contents keep a weak version of their ETag
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	testTools.DownloadContent(rr, req, strings.NewReader(text), time.Time{}, -1, "data.txt")
+	if !strings.HasPrefix(rr.Header().Get("ETag"), `W/"`) || rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("wrong headers: %v", rr.Header())
+	}
+}
@@ -0,0 +1,75 @@
+package toolkit
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrDigestMismatch is returned when the SHA-256 digest of an uploaded file differs from the one the client
+// sent in the DigestField form field
+var ErrDigestMismatch = errors.New("the uploaded file does not match its expected digest")
+
+// placeContentAddressed moves a file written to tempKey to the key named after its digest. When a file
+// with the same digest is already stored, the new copy is dropped instead
+func (u *upload) placeContentAddressed(tempKey string, uploadedFile *UploadedFile) error {
+	s := u.t.storage()
+	key := storageKey(u.uploadDir, uploadedFile.NewFileName)
+
+	if _, err := s.Stat(key); err == nil {
+		if u.deduplicated == nil {
+			u.deduplicated = make(map[*UploadedFile]bool)
+		}
+		u.deduplicated[uploadedFile] = true
+		uploadedFile.Key = key
+		return s.Delete(tempKey)
+	}
+
+	if err := moveObject(s, tempKey, key); err != nil {
+		s.Delete(tempKey)
+		return err
+	}
+
+	uploadedFile.Key = key
+	return nil
+}
+
+// setPosition records that uploadedFile is the file part at position in the request, the one whose
+// expected digest is the value at that position of DigestField
+func (u *upload) setPosition(uploadedFile *UploadedFile, position int) {
+	if u.positions == nil {
+		u.positions = make(map[*UploadedFile]int)
+	}
+	u.positions[uploadedFile] = position
+}
+
+// verifyDigests compares the digest of each uploaded file with the one the client sent for it. Every file
+// that does not match is removed, unless the upload is transactional and will be rolled back anyway, left
+// out of the returned files, and named in the error
+func (u *upload) verifyDigests(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
+	var remaining []*UploadedFile
+	var mismatched []string
+
+	for _, f := range uploadedFiles {
+		expected := ""
+		if i, ok := u.positions[f]; ok && i < len(u.expectedDigests) {
+			expected = strings.ToLower(strings.TrimSpace(u.expectedDigests[i]))
+		}
+
+		if expected == "" || expected == f.SHA256 {
+			remaining = append(remaining, f)
+			continue
+		}
+
+		if !u.t.TransactionalUploads {
+			u.remove(f)
+		}
+		mismatched = append(mismatched, strconv.Quote(f.OriginalFileName))
+	}
+
+	if len(mismatched) > 0 {
+		return remaining, fmt.Errorf("%w: %s", ErrDigestMismatch, strings.Join(mismatched, ", "))
+	}
+	return uploadedFiles, nil
+}
@@ -0,0 +1,188 @@
+package toolkit
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTools_UploadFilesDigests(t *testing.T) {
+	content := testPNG(t, 4, 4)
+	sha := sha256.Sum256(content)
+	md := md5.Sum(content)
+
+	testTools := Tools{Storage: &MemoryStorage{}, ComputeMD5: true}
+
+	uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testPart{field: "file", fileName: "img.png", content: content}), "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFiles[0].SHA256 != hex.EncodeToString(sha[:]) {
+		t.Errorf("wrong SHA-256 digest: %s", uploadedFiles[0].SHA256)
+	}
+
+	if uploadedFiles[0].MD5 != hex.EncodeToString(md[:]) {
+		t.Errorf("wrong MD5 digest: %s", uploadedFiles[0].MD5)
+	}
+}
+
+func TestTools_UploadFilesContentAddressed(t *testing.T) {
+	for _, transactional := range []bool{false, true} {
+		var store MemoryStorage
+		testTools := Tools{Storage: &store, ContentAddressed: true, TransactionalUploads: transactional}
+
+		content := testPNG(t, 4, 4)
+		sha := sha256.Sum256(content)
+		expectedKey := "uploads/" + hex.EncodeToString(sha[:]) + ".png"
+
+		var keys []string
+		for i := 0; i < 2; i++ {
+			request := newUploadRequest(t,
+				testPart{field: "file", fileName: "first.png", content: content},
+				testPart{field: "file", fileName: "second.png", content: content},
+			)
+
+			uploadedFiles, err := testTools.UploadFilesStream(request, "uploads", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, f := range uploadedFiles {
+				keys = append(keys, f.Key)
+			}
+		}
+
+		for _, key := range keys {
+			if key != expectedKey {
+				t.Errorf("transactional %t: expected key %s, but got %s", transactional, expectedKey, key)
+			}
+		}
+
+		saved, _ := store.List("uploads/")
+		if len(saved) != 1 {
+			t.Errorf("transactional %t: expected identical files to be stored once, but found %d files", transactional, len(saved))
+		}
+	}
+}
+
+func TestTools_UploadFilesDigestField(t *testing.T) {
+	content := testPNG(t, 4, 4)
+	sha := sha256.Sum256(content)
+
+	var digestTests = []struct {
+		name          string
+		digest        string
+		errorExpected bool
+	}{
+		{name: "matching digest", digest: hex.EncodeToString(sha[:]), errorExpected: false},
+		{name: "upper case digest with spaces", digest: " " + strings.ToUpper(hex.EncodeToString(sha[:])) + "\n", errorExpected: false},
+		{name: "wrong digest", digest: hex.EncodeToString(make([]byte, 32)), errorExpected: true},
+		{name: "empty digest", digest: "", errorExpected: false},
+	}
+
+	uploaders := map[string]func(*Tools, *http.Request) ([]*UploadedFile, error){
+		"UploadFiles": func(tools *Tools, r *http.Request) ([]*UploadedFile, error) {
+			return tools.UploadFiles(r, "uploads")
+		},
+		"UploadFilesStream": func(tools *Tools, r *http.Request) ([]*UploadedFile, error) {
+			return tools.UploadFilesStream(r, "uploads")
+		},
+	}
+
+	for uploaderName, upload := range uploaders {
+		for _, entry := range digestTests {
+			var store MemoryStorage
+			testTools := Tools{Storage: &store, DigestField: "sha256"}
+
+			request := newUploadRequest(t,
+				testPart{field: "sha256", content: []byte(entry.digest)},
+				testPart{field: "file", fileName: "img.png", content: content},
+			)
+
+			uploadedFiles, err := upload(&testTools, request)
+			saved, _ := store.List("uploads/")
+
+			if entry.errorExpected {
+				if !errors.Is(err, ErrDigestMismatch) {
+					t.Errorf("%s, %s: expected ErrDigestMismatch, but got %v", uploaderName, entry.name, err)
+				}
+				if len(saved) != 0 || len(uploadedFiles) != 0 {
+					t.Errorf("%s, %s: file with the wrong digest should be removed", uploaderName, entry.name)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Errorf("%s, %s: error not expected, but one received: %s", uploaderName, entry.name, err)
+			}
+
+			if len(saved) != 1 {
+				t.Errorf("%s, %s: expected file to be kept", uploaderName, entry.name)
+			}
+		}
+	}
+}
+
+func TestTools_UploadFilesDigestFieldReportsAll(t *testing.T) {
+	first, second, third := testPNG(t, 4, 4), testPNG(t, 8, 8), testPNG(t, 16, 16)
+	secondSHA := sha256.Sum256(second)
+	wrong := hex.EncodeToString(make([]byte, 32))
+
+	var store MemoryStorage
+	testTools := Tools{Storage: &store, DigestField: "sha256"}
+
+	request := newUploadRequest(t,
+		testPart{field: "sha256", content: []byte(wrong)},
+		testPart{field: "sha256", content: []byte(hex.EncodeToString(secondSHA[:]))},
+		testPart{field: "sha256", content: []byte(wrong)},
+		testPart{field: "file", fileName: "one.png", content: first},
+		testPart{field: "file", fileName: "two.png", content: second},
+		testPart{field: "file", fileName: "three.png", content: third},
+	)
+
+	uploadedFiles, err := testTools.UploadFiles(request, "uploads")
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch, but got %v", err)
+	}
+	if !strings.Contains(err.Error(), `"one.png"`) || !strings.Contains(err.Error(), `"three.png"`) || strings.Contains(err.Error(), `"two.png"`) {
+		t.Errorf("expected both mismatching files to be reported, but got %v", err)
+	}
+
+	if len(uploadedFiles) != 1 || uploadedFiles[0].OriginalFileName != "two.png" {
+		t.Errorf("expected only two.png to be returned, but got %d files", len(uploadedFiles))
+	}
+
+	saved, _ := store.List("uploads/")
+	if len(saved) != 1 {
+		t.Errorf("expected every mismatching file to be removed, but %d files are kept", len(saved))
+	}
+}
+
+func TestTools_UploadOneFileFieldDigestField(t *testing.T) {
+	first, second := []byte("first file"), []byte("second file")
+	firstSHA, secondSHA := sha256.Sum256(first), sha256.Sum256(second)
+
+	var store MemoryStorage
+	testTools := Tools{Storage: &store, DigestField: "sha256"}
+
+	// the digests follow the order of every file in the request, not only of the ones in the field
+	request := newUploadRequest(t,
+		testPart{field: "sha256", content: []byte(hex.EncodeToString(firstSHA[:]))},
+		testPart{field: "sha256", content: []byte(hex.EncodeToString(secondSHA[:]))},
+		testPart{field: "up", fileName: "a.txt", content: first},
+		testPart{field: "doc", fileName: "b.txt", content: second},
+	)
+
+	uploadedFile, err := testTools.UploadOneFileField(request, "uploads", "doc")
+	if err != nil {
+		t.Fatalf("error not expected, but one received: %s", err)
+	}
+	if uploadedFile.OriginalFileName != "b.txt" {
+		t.Errorf("expected b.txt to be uploaded, but got %s", uploadedFile.OriginalFileName)
+	}
+}
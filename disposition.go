@@ -0,0 +1,91 @@
+package toolkit
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Disposition is the type of the Content-Disposition header of downloads
+type Disposition int
+
+const (
+	// DispositionAttachment asks browsers to save the file
+	DispositionAttachment Disposition = iota
+	// DispositionInline lets browsers show the file, when they can
+	DispositionInline
+)
+
+func (d Disposition) String() string {
+	if d == DispositionInline {
+		return "inline"
+	}
+	return "attachment"
+}
+
+// ContentDisposition returns the value of a Content-Disposition header for a file named fileName, as
+// described in RFC 6266. Names that are plain ASCII are sent quoted in the filename parameter. Other names
+// get an ASCII approximation there, for old clients, and are sent in full, UTF-8 and percent encoded as
+// RFC 5987 describes, in the filename* parameter. Control characters, which could otherwise inject headers,
+// are removed
+func ContentDisposition(disposition Disposition, fileName string) string {
+	fileName = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(fileName, ""))
+
+	if strings.TrimSpace(fileName) == "" {
+		return disposition.String()
+	}
+
+	fallback := asciiFileName(fileName)
+
+	value := disposition.String() + `; filename="` + fallback + `"`
+	if fallback != fileName {
+		value += "; filename*=UTF-8''" + encodeRFC5987(fileName)
+	}
+	return value
+}
+
+// asciiFileName approximates name with printable ASCII characters: accents are dropped, and characters that
+// cannot be approximated, along with the ones that are special in a quoted string, become underscores
+func asciiFileName(name string) string {
+	var b strings.Builder
+
+	for _, r := range norm.NFD.String(name) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// combining marks, the accents split from their letter by NFD
+		case r == '"' || r == '\\' || r == '%':
+			b.WriteByte('_')
+		case r >= 0x20 && r < 0x7F:
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+
+	return b.String()
+}
+
+// encodeRFC5987 percent encodes s, leaving alone the characters RFC 5987 allows in a parameter value
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0F])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,44 @@
+package toolkit
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var contentDispositionTests = []struct {
+	name        string
+	disposition Disposition
+	fileName    string
+	expected    string
+}{
+	{name: "ascii", disposition: DispositionAttachment, fileName: "puppy.jpg", expected: `attachment; filename="puppy.jpg"`},
+	{name: "inline", disposition: DispositionInline, fileName: "puppy.jpg", expected: `inline; filename="puppy.jpg"`},
+	{name: "accents", disposition: DispositionAttachment, fileName: "relatório.pdf", expected: `attachment; filename="relatorio.pdf"; filename*=UTF-8''relat%C3%B3rio.pdf`},
+	{name: "non latin", disposition: DispositionAttachment, fileName: "日本.txt", expected: `attachment; filename="__.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.txt`},
+	{name: "quotes", disposition: DispositionAttachment, fileName: `say "hi".txt`, expected: `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+	{name: "header injection", disposition: DispositionAttachment, fileName: "a.txt\r\nSet-Cookie: x=1", expected: `attachment; filename="a.txtSet-Cookie: x=1"`},
+	{name: "empty", disposition: DispositionAttachment, fileName: "\n", expected: `attachment`},
+}
+
+func TestContentDisposition(t *testing.T) {
+	for _, entry := range contentDispositionTests {
+		if value := ContentDisposition(entry.disposition, entry.fileName); value != entry.expected {
+			t.Errorf("%s: expected %s, but got %s", entry.name, entry.expected, value)
+		}
+	}
+}
+
+func TestTools_DownloadStaticFileDisposition(t *testing.T) {
+	testTools := Tools{Disposition: DispositionInline}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	testTools.DownloadStaticFile(rr, req, "./testdata", "pic.jpg", "foto água.jpg")
+
+	disposition := rr.Header().Get("Content-Disposition")
+	if !strings.HasPrefix(disposition, `inline; filename="foto agua.jpg"; filename*=UTF-8''foto%20%C3%A1gua.jpg`) {
+		t.Errorf("wrong content disposition: %s", disposition)
+	}
+}
@@ -0,0 +1,429 @@
+package toolkit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RangeGetter is implemented by storages that can read part of an object. It lets DownloadObject serve
+// byte ranges of objects that cannot seek, such as the ones S3Storage reads
+type RangeGetter interface {
+	// GetRange returns a reader for length bytes of the contents kept under key, starting at offset.
+	// A negative length reads to the end
+	GetRange(key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// DownloadContent sends content to the client as an attachment named displayName. content is size bytes
+// long and was last modified at modTime, which may be zero when unknown. Single and multiple byte ranges
+// are served, along with a strong ETag, and the If-None-Match, If-Modified-Since, If-Range, If-Match and
+// If-Unmodified-Since conditions are honoured. The ETag is made of the size and modTime; only when modTime
+// is zero is it computed from the contents, which means reading them all. When a size of -1 is given, it
+// is found by seeking to the end of content
+func (t *Tools) DownloadContent(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, modTime time.Time, size int64, displayName string) {
+	if size < 0 {
+		end, err := content.Seek(0, io.SeekEnd)
+		if err != nil {
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		size = end
+	}
+
+	etag := fileETag(size, modTime)
+	if modTime.IsZero() {
+		var err error
+		if etag, err = contentETag(content, size); err != nil {
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w, done := t.compressResponse(w, r)
+	defer done()
+
+	t.setContentDisposition(w, displayName)
+	serveContent(w, r, displayName, modTime, content, etag)
+}
+
+// DownloadObject sends the file saved under key in Storage to the client as an attachment named displayName,
+// like DownloadContent does. The ETag reported by the storage is used when it has one, and one made of the
+// size and the modification time of the object otherwise. Objects are served
+// with ranges when the storage returns them seekable or implements RangeGetter, and whole otherwise
+func (t *Tools) DownloadObject(w http.ResponseWriter, r *http.Request, key, displayName string) {
+	w, done := t.compressResponse(w, r)
+	defer done()
+
+	t.setContentDisposition(w, displayName)
+	t.serveObject(w, r, key)
+}
+
+// DownloadFromFS sends the file named fileName in fsys to the client as an attachment named displayName.
+// fileName may come from the URL: names that are not valid fs.FS paths once cleaned, such as the ones
+// with ".." elements leaving the root or absolute ones, get a 404, as do directories and any error opening
+// the file, so nothing about the filesystem is leaked. Use ConfinedDirFS for a directory on disk.
+// With Compression set, a gzip compressed copy of the file named fileName+".gz" is sent instead to the
+// clients that accept it, and other files are compressed on the fly
+func (t *Tools) DownloadFromFS(w http.ResponseWriter, r *http.Request, fsys fs.FS, fileName, displayName string) {
+	name, ok := confinedName(fileName)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if t.serveGzipSibling(w, r, fsys, name, displayName) {
+		return
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w, done := t.compressResponse(w, r)
+	defer done()
+
+	t.setContentDisposition(w, displayName)
+
+	etag := fileETag(info.Size(), info.ModTime())
+
+	if content, ok := f.(io.ReadSeeker); ok {
+		serveContent(w, r, name, info.ModTime(), content, etag)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if notModified(r, etag, info.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+}
+
+// DownloadFromDir is DownloadFromFS for the directory root on disk, through ConfinedDirFS
+func (t *Tools) DownloadFromDir(w http.ResponseWriter, r *http.Request, root, fileName, displayName string) {
+	t.DownloadFromFS(w, r, ConfinedDirFS(root), fileName, displayName)
+}
+
+// confinedName cleans a file name that may come from a client into a path relative to a root, reporting
+// whether it stays inside the root
+func confinedName(fileName string) (string, bool) {
+	name := path.Clean(filepath.ToSlash(fileName))
+	if name == "." || !fs.ValidPath(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// ConfinedDirFS returns a file system for the directory root, like os.DirFS, which also refuses to open
+// files whose real path, once symbolic links are followed, is outside root. Links that stay inside root
+// are followed
+func ConfinedDirFS(root string) fs.FS {
+	return confinedDirFS(root)
+}
+
+type confinedDirFS string
+
+func (root confinedDirFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	realPath, err := root.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(realPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := root.checkOpened(name, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// checkOpened fails unless f, opened for name, is still the file name resolves to inside root. A link
+// swapped between resolving the path and opening it could otherwise have led outside root
+func (root confinedDirFS) checkOpened(name string, f *os.File) error {
+	opened, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	realPath, err := root.resolve(name)
+	if err != nil {
+		return err
+	}
+
+	current, err := os.Stat(realPath)
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(opened, current) {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+// resolve returns the real path of name under root, once symbolic links are followed, failing when it is
+// outside root
+func (root confinedDirFS) resolve(name string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(string(root))
+	if err != nil {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	realPath, err := filepath.EvalSymlinks(filepath.Join(realRoot, filepath.FromSlash(name)))
+	if err != nil {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+
+	return realPath, nil
+}
+
+// serveObject writes the file saved under key in Storage to w
+func (t *Tools) serveObject(w http.ResponseWriter, r *http.Request, key string) {
+	info, err := t.storage().Stat(key)
+	if err != nil {
+		serveStorageError(w, err)
+		return
+	}
+
+	etag := ""
+	if info.ETag != "" {
+		etag = strconv.Quote(info.ETag)
+	} else if !info.ModTime.IsZero() {
+		etag = fileETag(info.Size, info.ModTime)
+	}
+
+	if rg, ok := t.storage().(RangeGetter); ok {
+		content := &rangeReadSeeker{s: rg, key: key, size: info.Size}
+		defer content.Close()
+
+		serveContent(w, r, key, info.ModTime, content, etag)
+		return
+	}
+
+	obj, err := t.storage().Get(key)
+	if err != nil {
+		serveStorageError(w, err)
+		return
+	}
+	defer obj.Close()
+
+	if content, ok := obj.(io.ReadSeeker); ok {
+		if etag == "" {
+			if etag, err = contentETag(content, info.Size); err != nil {
+				serveStorageError(w, err)
+				return
+			}
+		}
+
+		serveContent(w, r, key, info.ModTime, content, etag)
+		return
+	}
+
+	// without seeking there are no ranges, but the conditions on the ETag and the date still apply
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, info.ModTime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if ctype := mime.TypeByExtension(path.Ext(key)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method != http.MethodHead {
+		io.Copy(w, obj)
+	}
+}
+
+func serveStorageError(w http.ResponseWriter, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+}
+
+// serveContent sets the ETag and the Content-Type guessed from the extension of name, and lets
+// http.ServeContent deal with ranges and conditions
+func serveContent(w http.ResponseWriter, r *http.Request, name string, modTime time.Time, content io.ReadSeeker, etag string) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	http.ServeContent(w, r, name, modTime, content)
+}
+
+func (t *Tools) setContentDisposition(w http.ResponseWriter, displayName string) {
+	w.Header().Set("Content-Disposition", ContentDisposition(t.Disposition, displayName))
+}
+
+// fileETag returns a strong ETag made of the size and the modification time of a file, which change
+// whenever the file is replaced, so it is found without reading the file
+func fileETag(size int64, modTime time.Time) string {
+	return fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size)
+}
+
+// contentETag returns a strong ETag made of the SHA-256 digest of the first size bytes of content, which
+// is left at its start. A negative size reads content to its end
+func contentETag(content io.ReadSeeker, size int64) (string, error) {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+
+	var err error
+	if size < 0 {
+		_, err = io.Copy(h, content)
+	} else {
+		_, err = io.CopyN(h, content, size)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// notModified reports whether the conditions of r let a 304 be sent instead of the contents
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || (etag != "" && candidate == strings.TrimPrefix(etag, "W/")) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modTime.Truncate(time.Second).After(t)
+	}
+
+	return false
+}
+
+// rangeReadSeeker reads an object through a RangeGetter, starting a new read whenever it is moved
+// somewhere else than where the current one is
+type rangeReadSeeker struct {
+	s    RangeGetter
+	key  string
+	size int64
+	pos  int64
+	rc   io.ReadCloser
+}
+
+func (r *rangeReadSeeker) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.rc == nil {
+		rc, err := r.s.GetRange(r.key, r.pos, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+	}
+
+	n, err := r.rc.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *rangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += r.size
+	}
+
+	if pos < 0 {
+		return 0, errors.New("seek before the start of the object")
+	}
+
+	if pos != r.pos {
+		r.Close()
+		r.pos = pos
+	}
+	return pos, nil
+}
+
+func (r *rangeReadSeeker) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
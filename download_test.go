@@ -0,0 +1,232 @@
+package toolkit
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTools_DownloadContent(t *testing.T) {
+	var testTools Tools
+
+	content := []byte("0123456789abcdefghij")
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	download := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rr := httptest.NewRecorder()
+		testTools.DownloadContent(rr, req, bytes.NewReader(content), modTime, int64(len(content)), "data.txt")
+		return rr
+	}
+
+	rr := download(nil)
+	etag := rr.Header().Get("ETag")
+
+	if rr.Code != http.StatusOK || rr.Body.String() != string(content) {
+		t.Fatalf("wrong full response: %d %q", rr.Code, rr.Body.String())
+	}
+	if !strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, "W/") {
+		t.Errorf("expected a strong ETag, but got %s", etag)
+	}
+	if rr.Header().Get("Content-Disposition") != `attachment; filename="data.txt"` || rr.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("wrong headers: %v", rr.Header())
+	}
+
+	var downloadTests = []struct {
+		name           string
+		headers        map[string]string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "range", headers: map[string]string{"Range": "bytes=2-5"}, expectedStatus: http.StatusPartialContent, expectedBody: "2345"},
+		{name: "suffix range", headers: map[string]string{"Range": "bytes=-3"}, expectedStatus: http.StatusPartialContent, expectedBody: "hij"},
+		{name: "unsatisfiable range", headers: map[string]string{"Range": "bytes=100-"}, expectedStatus: http.StatusRequestedRangeNotSatisfiable},
+		{name: "if none match", headers: map[string]string{"If-None-Match": etag}, expectedStatus: http.StatusNotModified},
+		{name: "if none match other", headers: map[string]string{"If-None-Match": `"other"`}, expectedStatus: http.StatusOK, expectedBody: string(content)},
+		{name: "if modified since", headers: map[string]string{"If-Modified-Since": modTime.Format(http.TimeFormat)}, expectedStatus: http.StatusNotModified},
+		{name: "if range match", headers: map[string]string{"Range": "bytes=0-1", "If-Range": etag}, expectedStatus: http.StatusPartialContent, expectedBody: "01"},
+		{name: "if range changed", headers: map[string]string{"Range": "bytes=0-1", "If-Range": `"other"`}, expectedStatus: http.StatusOK, expectedBody: string(content)},
+	}
+
+	for _, entry := range downloadTests {
+		rr := download(entry.headers)
+
+		if rr.Code != entry.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", entry.name, entry.expectedStatus, rr.Code)
+		}
+		if entry.expectedBody != "" && rr.Body.String() != entry.expectedBody {
+			t.Errorf("%s: expected body %q, but got %q", entry.name, entry.expectedBody, rr.Body.String())
+		}
+	}
+
+	rr = download(map[string]string{"Range": "bytes=0-1,10-11"})
+	if rr.Code != http.StatusPartialContent || !strings.HasPrefix(rr.Header().Get("Content-Type"), "multipart/byteranges") ||
+		!strings.Contains(rr.Body.String(), "01") || !strings.Contains(rr.Body.String(), "ab") {
+		t.Errorf("wrong multipart range response: %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+}
+
+func TestTools_DownloadObjectFromS3(t *testing.T) {
+	s, fake := newTestS3Storage(t)
+	testTools := Tools{Storage: s}
+
+	content := []byte("0123456789abcdefghij")
+	if _, err := s.Put("files/data.txt", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=10-13")
+	rr := httptest.NewRecorder()
+
+	testTools.DownloadObject(rr, req, "files/data.txt", "data.txt")
+
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "abcd" {
+		t.Errorf("wrong range response: %d %q", rr.Code, rr.Body.String())
+	}
+	if fake.ranges == 0 {
+		t.Error("expected the range to be read with a Range request")
+	}
+
+	etag := rr.Header().Get("ETag")
+	if etag != `"`+fake.etag(content)+`"` {
+		t.Errorf("expected the ETag of the storage, but got %s", etag)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+
+	testTools.DownloadObject(rr, req, "files/data.txt", "data.txt")
+
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching ETag, but got %d", rr.Code)
+	}
+}
+
+func TestTools_DownloadFromDir(t *testing.T) {
+	var testTools Tools
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	_ = os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	_ = os.WriteFile(filepath.Join(root, "sub", "file.txt"), []byte("inside"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("outside"), 0644)
+
+	if err := os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "escape.txt")); err != nil {
+		t.Skip("symbolic links are not supported:", err)
+	}
+	_ = os.Symlink(filepath.Join(root, "sub", "file.txt"), filepath.Join(root, "link.txt"))
+	_ = os.Symlink(dir, filepath.Join(root, "parent"))
+
+	var downloadTests = []struct {
+		name           string
+		fileName       string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "file", fileName: "sub/file.txt", expectedStatus: http.StatusOK, expectedBody: "inside"},
+		{name: "cleaned", fileName: "sub/../sub/./file.txt", expectedStatus: http.StatusOK, expectedBody: "inside"},
+		{name: "link inside", fileName: "link.txt", expectedStatus: http.StatusOK, expectedBody: "inside"},
+		{name: "parent", fileName: "../secret.txt", expectedStatus: http.StatusNotFound},
+		{name: "nested parent", fileName: "sub/../../secret.txt", expectedStatus: http.StatusNotFound},
+		{name: "absolute", fileName: filepath.Join(dir, "secret.txt"), expectedStatus: http.StatusNotFound},
+		{name: "link outside", fileName: "escape.txt", expectedStatus: http.StatusNotFound},
+		{name: "directory link outside", fileName: "parent/secret.txt", expectedStatus: http.StatusNotFound},
+		{name: "directory", fileName: "sub", expectedStatus: http.StatusNotFound},
+		{name: "root", fileName: "", expectedStatus: http.StatusNotFound},
+		{name: "missing", fileName: "missing.txt", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, entry := range downloadTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		rr := httptest.NewRecorder()
+		testTools.DownloadFromDir(rr, req, root, entry.fileName, "download.txt")
+
+		if rr.Code != entry.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", entry.name, entry.expectedStatus, rr.Code)
+		}
+		if entry.expectedBody != "" && rr.Body.String() != entry.expectedBody {
+			t.Errorf("%s: expected body %q, but got %q", entry.name, entry.expectedBody, rr.Body.String())
+		}
+		if strings.Contains(rr.Body.String(), dir) || strings.Contains(rr.Body.String(), "outside") {
+			t.Errorf("%s: the response leaks the filesystem: %q", entry.name, rr.Body.String())
+		}
+	}
+
+	// DownloadStaticFile is confined to pathName the same way
+	req := httptest.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	testTools.DownloadStaticFile(rr, req, root, "../secret.txt", "secret.txt")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected DownloadStaticFile to refuse a parent directory, but got %d", rr.Code)
+	}
+}
+
+// countingReadSeeker counts the bytes read from a bytes.Reader
+type countingReadSeeker struct {
+	*bytes.Reader
+	read int
+}
+
+func (c *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestTools_DownloadETagWithoutReading(t *testing.T) {
+	var testTools Tools
+
+	content := &countingReadSeeker{Reader: bytes.NewReader(bytes.Repeat([]byte("a"), 1<<20))}
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	rr := httptest.NewRecorder()
+	testTools.DownloadContent(rr, req, content, modTime, -1, "data.txt")
+
+	if rr.Code != http.StatusPartialContent || rr.Header().Get("ETag") == "" {
+		t.Fatalf("wrong response: %d %v", rr.Code, rr.Header())
+	}
+	if content.read > 1024 {
+		t.Errorf("expected a range to read only what it sends, but %d bytes were read", content.read)
+	}
+
+	// files served from a directory get an ETag the same way
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "file.txt"), []byte("some text"), 0644)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	rr = httptest.NewRecorder()
+	testTools.DownloadStaticFile(rr, req, dir, "file.txt", "file.txt")
+
+	etag := rr.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("expected a strong ETag, but got %q", etag)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	testTools.DownloadStaticFile(rr, req, dir, "file.txt", "file.txt")
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching ETag, but got %d", rr.Code)
+	}
+
+	// and so do stored objects, whatever storage keeps them
+	testTools.Storage = LocalStorage{Root: dir}
+	rr = httptest.NewRecorder()
+	testTools.DownloadObject(rr, req, "file.txt", "file.txt")
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a stored object, but got %d", rr.Code)
+	}
+}
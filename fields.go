@@ -0,0 +1,113 @@
+package toolkit
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// ErrTooManyFiles is returned, wrapped in a *FieldError, when a field holds more files than its MaxFiles
+	ErrTooManyFiles = errors.New("too many files")
+	// ErrTooFewFiles is returned, wrapped in a *FieldError, when a field holds fewer files than its
+	// MinFiles, or none when it is Required
+	ErrTooFewFiles = errors.New("not enough files")
+)
+
+// FieldRule is what is accepted in one file field of an upload form. Zero values fall back to the
+// settings of Tools, so a rule only needs the limits that differ
+type FieldRule struct {
+	// AllowedFileTypes are the MIME types accepted in the field. When empty, Tools.AllowedFileTypes applies
+	AllowedFileTypes []string
+	// MaxFileSize is the largest size, in bytes, of each file in the field. When zero, Tools.MaxFileSize applies
+	MaxFileSize int
+	// MinFiles and MaxFiles are the fewest and most files the field may hold. A MaxFiles of zero means
+	// no limit
+	MinFiles int
+	MaxFiles int
+	// Required is the same as a MinFiles of one
+	Required bool
+}
+
+// FieldError reports the form field an uploaded file that was rejected came from
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field %q: %s", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// fieldLimits returns the size limit and the allowed types of the files in field
+func (u *upload) fieldLimits(field string) (int64, []string) {
+	limit, allowed := u.t.maxFileSize(), u.t.AllowedFileTypes
+
+	if rule, ok := u.t.FieldRules[field]; ok {
+		if rule.MaxFileSize > 0 {
+			limit = int64(rule.MaxFileSize)
+		}
+		if len(rule.AllowedFileTypes) > 0 {
+			allowed = rule.AllowedFileTypes
+		}
+	}
+
+	return limit, allowed
+}
+
+// countFile records one more file in field, failing when the field goes over its MaxFiles or the request
+// over maxFiles
+func (u *upload) countFile(field string) error {
+	u.fileCount++
+	if u.maxFiles > 0 && u.fileCount > u.maxFiles {
+		return u.fileCountError(ErrTooManyFiles, fmt.Sprintf("at most %d allowed", u.maxFiles))
+	}
+
+	if u.fieldCounts == nil {
+		u.fieldCounts = make(map[string]int)
+	}
+	u.fieldCounts[field]++
+
+	if rule, ok := u.t.FieldRules[field]; ok && rule.MaxFiles > 0 && u.fieldCounts[field] > rule.MaxFiles {
+		return &FieldError{Field: field, Err: fmt.Errorf("%w: at most %d allowed", ErrTooManyFiles, rule.MaxFiles)}
+	}
+	return nil
+}
+
+// checkFieldCounts fails when a field holds fewer files than its rule asks for. Fields are checked in
+// alphabetical order, so the same request always gets the same error
+func (u *upload) checkFieldCounts() error {
+	fields := make([]string, 0, len(u.t.FieldRules))
+	for field := range u.t.FieldRules {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		rule := u.t.FieldRules[field]
+
+		min := rule.MinFiles
+		if rule.Required && min < 1 {
+			min = 1
+		}
+
+		if u.fieldCounts[field] < min {
+			return &FieldError{Field: field, Err: fmt.Errorf("%w: at least %d required", ErrTooFewFiles, min)}
+		}
+	}
+	return nil
+}
+
+// fileCountError reports a wrong number of files in the request, naming the field when only the files of
+// one field are saved
+func (u *upload) fileCountError(err error, detail string) error {
+	err = fmt.Errorf("%w: %s", err, detail)
+	if u.onlyField != "" {
+		return &FieldError{Field: u.onlyField, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package toolkit
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+var fieldRuleTests = []struct {
+	name          string
+	parts         []testPart
+	expectedField string
+	expectedErr   error
+}{
+	{name: "valid", parts: []testPart{
+		{field: "avatar", fileName: "me.png", content: testPNGBytes},
+		{field: "attachments", fileName: "a.pdf", content: []byte("%PDF-1.7\n")},
+		{field: "attachments", fileName: "b.pdf", content: []byte("%PDF-1.7\n")},
+	}},
+	{name: "missing required", parts: []testPart{
+		{field: "attachments", fileName: "a.pdf", content: []byte("%PDF-1.7\n")},
+	}, expectedField: "avatar", expectedErr: ErrTooFewFiles},
+	{name: "too many", parts: []testPart{
+		{field: "avatar", fileName: "me.png", content: testPNGBytes},
+		{field: "avatar", fileName: "me-too.png", content: testPNGBytes},
+	}, expectedField: "avatar", expectedErr: ErrTooManyFiles},
+	{name: "field type", parts: []testPart{
+		{field: "avatar", fileName: "me.pdf", content: []byte("%PDF-1.7\n")},
+	}, expectedField: "avatar"},
+	{name: "field size", parts: []testPart{
+		{field: "avatar", fileName: "me.png", content: testPNGBytes},
+		{field: "attachments", fileName: "big.pdf", content: append([]byte("%PDF-1.7\n"), bytes.Repeat([]byte("a"), 2000)...)},
+	}, expectedField: "attachments", expectedErr: ErrFileTooLarge},
+}
+
+// testPNGBytes is a png image of 1x1 pixel
+var testPNGBytes = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89\x00\x00\x00\rIDATx\x9cc\xf8\x0f\x00\x00\x01\x01\x00\x05\x18\xd8N\x00\x00\x00\x00IEND\xaeB`\x82")
+
+func TestTools_UploadFilesFieldRules(t *testing.T) {
+	uploaders := map[string]func(*Tools, *http.Request) ([]*UploadedFile, error){
+		"UploadFiles": func(tools *Tools, r *http.Request) ([]*UploadedFile, error) {
+			return tools.UploadFiles(r, "uploads")
+		},
+		"UploadFilesStream": func(tools *Tools, r *http.Request) ([]*UploadedFile, error) {
+			return tools.UploadFilesStream(r, "uploads")
+		},
+	}
+
+	for uploaderName, upload := range uploaders {
+		for _, entry := range fieldRuleTests {
+			testTools := Tools{
+				Storage:              &MemoryStorage{},
+				TransactionalUploads: true,
+				FieldRules: map[string]FieldRule{
+					"avatar":      {AllowedFileTypes: []string{"image/png"}, MaxFileSize: 1000, Required: true, MaxFiles: 1},
+					"attachments": {AllowedFileTypes: []string{"application/pdf"}, MaxFileSize: 1000, MaxFiles: 10},
+				},
+			}
+
+			uploadedFiles, err := upload(&testTools, newUploadRequest(t, entry.parts...))
+
+			if entry.expectedField == "" {
+				if err != nil {
+					t.Errorf("%s, %s: error not expected, but one received: %s", uploaderName, entry.name, err)
+				}
+				if len(uploadedFiles) != len(entry.parts) {
+					t.Errorf("%s, %s: expected %d files, but got %d", uploaderName, entry.name, len(entry.parts), len(uploadedFiles))
+				}
+				continue
+			}
+
+			var fieldErr *FieldError
+			if !errors.As(err, &fieldErr) || fieldErr.Field != entry.expectedField {
+				t.Errorf("%s, %s: expected a *FieldError for %s, but got %v", uploaderName, entry.name, entry.expectedField, err)
+			}
+
+			if entry.expectedErr != nil && !errors.Is(err, entry.expectedErr) {
+				t.Errorf("%s, %s: expected error %v, but got %v", uploaderName, entry.name, entry.expectedErr, err)
+			}
+		}
+	}
+}
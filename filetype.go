@@ -0,0 +1,451 @@
+package toolkit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sniffLen is how many bytes from the start of an uploaded file are used to detect its type. It is more
+// than the 512 bytes http.DetectContentType looks at, so the first entries of zip files can be inspected
+const sniffLen = 4096
+
+// FileType is a kind of file recognised by a FileTypeRegistry
+type FileType struct {
+	// MIME is the media type, such as "image/png"
+	MIME string
+	// Extension is the usual extension for the type, including the dot, such as ".png"
+	Extension string
+}
+
+// FileTypeMatcher reports whether buf, the first bytes of a file, belong to a given type. buf may hold
+// the whole file when it is small, so matchers must check its length
+type FileTypeMatcher func(buf []byte) bool
+
+// FileTypeRegistry detects the type of files from their first bytes, using magic numbers and, for zip based
+// formats such as docx or odt, the names of the first entries of the archive. When no registered type
+// matches, it falls back to http.DetectContentType. It is safe for concurrent use
+type FileTypeRegistry struct {
+	mu    sync.RWMutex
+	types []registeredFileType
+}
+
+type registeredFileType struct {
+	fileType FileType
+	match    FileTypeMatcher
+}
+
+// DefaultFileTypes is the registry used by Tools when FileTypes is nil. Types registered in it are
+// recognised by every Tools that does not have its own registry
+var DefaultFileTypes = NewFileTypeRegistry()
+
+// NewFileTypeRegistry returns a registry that knows the common image, document, archive, audio and video
+// formats. The zero value of FileTypeRegistry knows no types at all
+func NewFileTypeRegistry() *FileTypeRegistry {
+	r := &FileTypeRegistry{}
+
+	r.RegisterSignature(FileType{"image/png", ".png"}, 0, []byte("\x89PNG\r\n\x1a\n"))
+	r.RegisterSignature(FileType{"image/jpeg", ".jpg"}, 0, []byte{0xFF, 0xD8, 0xFF})
+	r.RegisterSignature(FileType{"image/gif", ".gif"}, 0, []byte("GIF87a"))
+	r.RegisterSignature(FileType{"image/gif", ".gif"}, 0, []byte("GIF89a"))
+	r.RegisterSignature(FileType{"image/bmp", ".bmp"}, 0, []byte("BM"))
+	r.RegisterSignature(FileType{"image/tiff", ".tif"}, 0, []byte("II*\x00"))
+	r.RegisterSignature(FileType{"image/tiff", ".tif"}, 0, []byte("MM\x00*"))
+	r.RegisterSignature(FileType{"image/x-icon", ".ico"}, 0, []byte{0x00, 0x00, 0x01, 0x00})
+	r.Register(FileType{"image/webp", ".webp"}, riffMatcher("WEBP"))
+	r.Register(FileType{"image/heic", ".heic"}, ftypMatcher("heic", "heix", "hevc", "hevx", "heim", "heis"))
+	r.Register(FileType{"image/heif", ".heif"}, ftypMatcher("mif1", "msf1"))
+	r.Register(FileType{"image/avif", ".avif"}, ftypMatcher("avif", "avis"))
+
+	r.RegisterSignature(FileType{"application/pdf", ".pdf"}, 0, []byte("%PDF-"))
+	r.RegisterSignature(FileType{"application/wasm", ".wasm"}, 0, []byte("\x00asm"))
+	r.RegisterSignature(FileType{"font/woff", ".woff"}, 0, []byte("wOFF"))
+	r.RegisterSignature(FileType{"font/woff2", ".woff2"}, 0, []byte("wOF2"))
+
+	r.RegisterSignature(FileType{"application/gzip", ".gz"}, 0, []byte{0x1F, 0x8B})
+	r.RegisterSignature(FileType{"application/x-bzip2", ".bz2"}, 0, []byte("BZh"))
+	r.RegisterSignature(FileType{"application/x-xz", ".xz"}, 0, []byte{0xFD, '7', 'z', 'X', 'Z', 0x00})
+	r.RegisterSignature(FileType{"application/zstd", ".zst"}, 0, []byte{0x28, 0xB5, 0x2F, 0xFD})
+	r.RegisterSignature(FileType{"application/x-7z-compressed", ".7z"}, 0, []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C})
+	r.RegisterSignature(FileType{"application/vnd.rar", ".rar"}, 0, []byte("Rar!\x1a\x07"))
+	r.RegisterSignature(FileType{"application/x-tar", ".tar"}, 257, []byte("ustar"))
+	r.RegisterSignature(FileType{"application/zip", ".zip"}, 0, []byte("PK\x03\x04"))
+	r.RegisterSignature(FileType{"application/zip", ".zip"}, 0, []byte("PK\x05\x06"))
+
+	// zip based formats are registered after zip itself, so they are checked first
+	r.Register(FileType{"application/java-archive", ".jar"}, zipEntryMatcher("META-INF/MANIFEST.MF"))
+	r.Register(FileType{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", ".docx"}, zipEntryMatcher("word/"))
+	r.Register(FileType{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", ".xlsx"}, zipEntryMatcher("xl/"))
+	r.Register(FileType{"application/vnd.openxmlformats-officedocument.presentationml.presentation", ".pptx"}, zipEntryMatcher("ppt/"))
+	for _, ft := range []FileType{
+		{"application/vnd.oasis.opendocument.text", ".odt"},
+		{"application/vnd.oasis.opendocument.spreadsheet", ".ods"},
+		{"application/vnd.oasis.opendocument.presentation", ".odp"},
+		{"application/epub+zip", ".epub"},
+	} {
+		r.Register(ft, zipMimetypeMatcher(ft.MIME))
+	}
+
+	r.RegisterSignature(FileType{"audio/mpeg", ".mp3"}, 0, []byte("ID3"))
+	r.RegisterSignature(FileType{"audio/ogg", ".ogg"}, 0, []byte("OggS"))
+	r.RegisterSignature(FileType{"audio/flac", ".flac"}, 0, []byte("fLaC"))
+	r.Register(FileType{"audio/wav", ".wav"}, riffMatcher("WAVE"))
+	r.Register(FileType{"video/x-msvideo", ".avi"}, riffMatcher("AVI "))
+	r.Register(FileType{"video/mp4", ".mp4"}, ftypMatcher("isom", "iso2", "mp41", "mp42", "avc1", "dash"))
+	r.Register(FileType{"video/quicktime", ".mov"}, ftypMatcher("qt  "))
+	r.RegisterSignature(FileType{"video/webm", ".webm"}, 0, []byte{0x1A, 0x45, 0xDF, 0xA3})
+
+	return r
+}
+
+// Register adds a file type recognised by match. Types are checked in the reverse order they were
+// registered, so a new type takes precedence over the ones already known
+func (r *FileTypeRegistry) Register(fileType FileType, match FileTypeMatcher) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.types = append(r.types, registeredFileType{fileType: fileType, match: match})
+}
+
+// RegisterSignature adds a file type recognised by the magic bytes signature found at offset
+func (r *FileTypeRegistry) RegisterSignature(fileType FileType, offset int, signature []byte) {
+	r.Register(fileType, func(buf []byte) bool {
+		return len(buf) >= offset+len(signature) && bytes.Equal(buf[offset:offset+len(signature)], signature)
+	})
+}
+
+// Detect returns the type of the file starting with buf
+func (r *FileTypeRegistry) Detect(buf []byte) FileType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for i := len(r.types) - 1; i >= 0; i-- {
+		if r.types[i].match(buf) {
+			return r.types[i].fileType
+		}
+	}
+
+	fileType := FileType{MIME: http.DetectContentType(buf)}
+	fileType.Extension = extensionForType(fileType.MIME)
+
+	return fileType
+}
+
+// sniffedExtensions holds the extensions of the types http.DetectContentType reports that have no
+// registered signature. Unknown binary files have no extension
+var sniffedExtensions = map[string]string{
+	"application/octet-stream":      "",
+	"text/plain":                    ".txt",
+	"text/html":                     ".html",
+	"text/xml":                      ".xml",
+	"application/postscript":        ".ps",
+	"application/vnd.ms-fontobject": ".eot",
+	"font/ttf":                      ".ttf",
+	"font/otf":                      ".otf",
+	"font/collection":               ".ttc",
+	"audio/aiff":                    ".aiff",
+	"audio/midi":                    ".mid",
+}
+
+// extensionForType returns the usual extension of mimeType, or an empty string when there is none
+func extensionForType(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return ""
+	}
+
+	if ext, ok := sniffedExtensions[mediaType]; ok {
+		return ext
+	}
+
+	extensions, _ := mime.ExtensionsByType(mediaType)
+	if len(extensions) == 0 {
+		return ""
+	}
+
+	sort.Strings(extensions)
+	return extensions[0]
+}
+
+// fileTypes returns the registry used by t
+func (t *Tools) fileTypes() *FileTypeRegistry {
+	if t.FileTypes != nil {
+		return t.FileTypes
+	}
+	return DefaultFileTypes
+}
+
+// fileTypeAllowed reports whether fileType is in allowed. Entries are compared with the whole MIME type,
+// parameters included, or with the media type alone, so both "text/plain" and
+// "text/plain; charset=utf-8" allow a detected "text/plain; charset=utf-8"
+func fileTypeAllowed(allowed []string, fileType FileType) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	mediaType := baseMediaType(fileType.MIME)
+
+	for _, typeReceived := range allowed {
+		if strings.EqualFold(fileType.MIME, typeReceived) || strings.EqualFold(mediaType, typeReceived) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtensionPolicy tells the upload functions what to do when the extension of an uploaded file, or the
+// Content-Type sent with it, disagrees with the type detected from its contents
+type ExtensionPolicy int
+
+const (
+	// ExtensionKeep always keeps the extension of the original file name
+	ExtensionKeep ExtensionPolicy = iota
+	// ExtensionReject fails the upload with ErrExtensionMismatch when the extension or the Content-Type of
+	// the file disagrees with its detected type. Renamed files get the extension of the detected type
+	ExtensionReject
+	// ExtensionCorrect replaces an extension that disagrees with the detected type by the extension of that
+	// type, or drops it when the type has none. Renamed files always get the extension of the detected type
+	ExtensionCorrect
+)
+
+// ErrExtensionMismatch is returned when ExtensionPolicy is ExtensionReject and an uploaded file is not what
+// its extension or Content-Type claim
+var ErrExtensionMismatch = errors.New("the uploaded file does not match its extension or content type")
+
+// extensionAliases are the other extensions commonly used for the extensions the registry reports
+var extensionAliases = map[string][]string{
+	".jpg":  {".jpeg", ".jpe", ".jfif"},
+	".tif":  {".tiff"},
+	".html": {".htm"},
+	".mid":  {".midi"},
+	".heic": {".heif"},
+	".gz":   {".tgz"},
+}
+
+// plainTextExtensions are extensions of text formats that are detected as text/plain, with the
+// Content-Types other than text/* that clients send for them
+var plainTextExtensions = map[string][]string{
+	".txt":    nil,
+	".text":   nil,
+	".csv":    nil,
+	".tsv":    nil,
+	".md":     nil,
+	".log":    nil,
+	".ini":    nil,
+	".json":   {"application/json"},
+	".ndjson": {"application/x-ndjson", "application/ndjson"},
+	".jsonl":  {"application/jsonl", "application/x-ndjson"},
+	".yaml":   {"application/yaml", "application/x-yaml"},
+	".yml":    {"application/yaml", "application/x-yaml"},
+}
+
+// xmlTypes are the types of XML based formats, which are detected as text/xml
+var xmlTypes = map[string]string{
+	"application/xml":       ".xml",
+	"image/svg+xml":         ".svg",
+	"application/rss+xml":   ".rss",
+	"application/atom+xml":  ".atom",
+	"application/xhtml+xml": ".xhtml",
+}
+
+// isPlainTextType reports whether contentType is the type of one of plainTextExtensions
+func isPlainTextType(contentType string) bool {
+	if strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	for _, types := range plainTextExtensions {
+		if containsString(types, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// genericContentTypes are sent by clients that do not know the type of a file, so they never disagree
+// with the detected type
+var genericContentTypes = []string{"", "application/octet-stream", "binary/octet-stream"}
+
+// extensionMatches reports whether ext is a reasonable extension for fileType
+func extensionMatches(ext string, fileType FileType) bool {
+	ext = strings.ToLower(ext)
+	mediaType := baseMediaType(fileType.MIME)
+
+	if ext == fileType.Extension || containsString(extensionAliases[fileType.Extension], ext) {
+		return true
+	}
+
+	if _, ok := plainTextExtensions[ext]; ok && mediaType == "text/plain" {
+		return true
+	}
+
+	if mediaType == "text/xml" {
+		for _, xmlExt := range xmlTypes {
+			if ext == xmlExt {
+				return true
+			}
+		}
+	}
+
+	// extensions with no known type, such as .dat, only match types that are not known either
+	extType := baseMediaType(mime.TypeByExtension(ext))
+	if extType == "" {
+		return fileType.Extension == ""
+	}
+
+	return extType == mediaType
+}
+
+// contentTypeMatches reports whether the Content-Type a client sent for a file agrees with fileType
+func contentTypeMatches(contentType string, fileType FileType) bool {
+	declared := baseMediaType(contentType)
+	mediaType := baseMediaType(fileType.MIME)
+
+	if containsString(genericContentTypes, declared) || declared == mediaType {
+		return true
+	}
+
+	if mediaType == "text/plain" && isPlainTextType(declared) {
+		return true
+	}
+
+	if _, ok := xmlTypes[declared]; ok && mediaType == "text/xml" {
+		return true
+	}
+
+	// clients usually derive the Content-Type from the extension, which may be an alias
+	return fileType.Extension != "" && baseMediaType(mime.TypeByExtension(fileType.Extension)) == declared
+}
+
+// storedExtension returns the extension a file named fileName is saved with, according to t.ExtensionPolicy
+func (t *Tools) storedExtension(fileName, contentType string, fileType FileType, renameFile bool) (string, error) {
+	ext := filepath.Ext(fileName)
+
+	if t.ExtensionPolicy == ExtensionKeep {
+		return ext, nil
+	}
+
+	matches := extensionMatches(ext, fileType)
+
+	if t.ExtensionPolicy == ExtensionReject && (!matches || !contentTypeMatches(contentType, fileType)) {
+		return "", fmt.Errorf("%w: %q was detected as %s", ErrExtensionMismatch, fileName, fileType.MIME)
+	}
+
+	if renameFile || !matches {
+		return fileType.Extension, nil
+	}
+	return ext, nil
+}
+
+// baseMediaType returns the lowercase media type of contentType, without parameters
+func baseMediaType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// riffMatcher matches RIFF containers, such as WebP or WAV, holding the given form type
+func riffMatcher(form string) FileTypeMatcher {
+	return func(buf []byte) bool {
+		return len(buf) >= 12 && string(buf[:4]) == "RIFF" && string(buf[8:12]) == form
+	}
+}
+
+// ftypMatcher matches ISO base media files, such as MP4 or HEIC, whose major brand is one of brands
+func ftypMatcher(brands ...string) FileTypeMatcher {
+	return func(buf []byte) bool {
+		if len(buf) < 12 || string(buf[4:8]) != "ftyp" {
+			return false
+		}
+
+		for _, brand := range brands {
+			if string(buf[8:12]) == brand {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// zipEntries calls fn with the name and the start of the data of each zip local file header found in buf.
+// Only the start of the archive is available, so the headers are found by their signature rather than
+// by reading the central directory. fn returns false to stop
+func zipEntries(buf []byte, fn func(name string, data []byte) bool) {
+	signature := []byte("PK\x03\x04")
+
+	if !bytes.HasPrefix(buf, signature) {
+		return
+	}
+
+	for offset := 0; ; {
+		i := bytes.Index(buf[offset:], signature)
+		if i < 0 {
+			return
+		}
+		offset += i
+
+		if len(buf) < offset+30 {
+			return
+		}
+
+		nameLen := int(binary.LittleEndian.Uint16(buf[offset+26:]))
+		extraLen := int(binary.LittleEndian.Uint16(buf[offset+28:]))
+		nameEnd := offset + 30 + nameLen
+		if len(buf) < nameEnd {
+			return
+		}
+
+		dataStart := nameEnd + extraLen
+		if dataStart > len(buf) {
+			dataStart = len(buf)
+		}
+
+		if !fn(string(buf[offset+30:nameEnd]), buf[dataStart:]) {
+			return
+		}
+
+		offset = nameEnd
+	}
+}
+
+// zipEntryMatcher matches zip files with an entry whose name starts with prefix
+func zipEntryMatcher(prefix string) FileTypeMatcher {
+	return func(buf []byte) bool {
+		found := false
+
+		zipEntries(buf, func(name string, _ []byte) bool {
+			found = strings.HasPrefix(name, prefix)
+			return !found
+		})
+
+		return found
+	}
+}
+
+// zipMimetypeMatcher matches zip files whose first entry is an uncompressed "mimetype" file holding
+// mimeType, as OpenDocument and EPUB files have
+func zipMimetypeMatcher(mimeType string) FileTypeMatcher {
+	return func(buf []byte) bool {
+		found := false
+
+		zipEntries(buf, func(name string, data []byte) bool {
+			found = name == "mimetype" && bytes.HasPrefix(data, []byte(mimeType))
+			return false
+		})
+
+		return found
+	}
+}
@@ -0,0 +1,190 @@
+package toolkit
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// testZip builds a zip archive holding the named entries. Entries named "mimetype" are stored
+// uncompressed, as OpenDocument files require
+func testZip(t *testing.T, entries ...string) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	for _, name := range entries {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		content := []byte("<xml>some content for " + name + "</xml>")
+
+		if name == "mimetype" {
+			header.Method = zip.Store
+			content = []byte("application/vnd.oasis.opendocument.text")
+		}
+
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFileTypeRegistry_Detect(t *testing.T) {
+	tar := make([]byte, 512)
+	copy(tar[257:], "ustar")
+
+	var detectTests = []struct {
+		name         string
+		content      []byte
+		expectedMIME string
+		expectedExt  string
+	}{
+		{name: "png", content: testPNG(t, 2, 2), expectedMIME: "image/png", expectedExt: ".png"},
+		{name: "jpeg", content: []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 'J', 'F', 'I', 'F'}, expectedMIME: "image/jpeg", expectedExt: ".jpg"},
+		{name: "webp lossless", content: []byte("RIFF\x1a\x00\x00\x00WEBPVP8L"), expectedMIME: "image/webp", expectedExt: ".webp"},
+		{name: "webp extended", content: []byte("RIFF\x1a\x00\x00\x00WEBPVP8X"), expectedMIME: "image/webp", expectedExt: ".webp"},
+		{name: "heic", content: []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), expectedMIME: "image/heic", expectedExt: ".heic"},
+		{name: "pdf", content: []byte("%PDF-1.7\n"), expectedMIME: "application/pdf", expectedExt: ".pdf"},
+		{name: "tar", content: tar, expectedMIME: "application/x-tar", expectedExt: ".tar"},
+		{name: "7z", content: []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C, 0x00, 0x04}, expectedMIME: "application/x-7z-compressed", expectedExt: ".7z"},
+		{name: "zip", content: testZip(t, "readme.txt"), expectedMIME: "application/zip", expectedExt: ".zip"},
+		{name: "docx", content: testZip(t, "[Content_Types].xml", "_rels/.rels", "word/document.xml"), expectedMIME: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", expectedExt: ".docx"},
+		{name: "xlsx", content: testZip(t, "[Content_Types].xml", "_rels/.rels", "xl/workbook.xml"), expectedMIME: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", expectedExt: ".xlsx"},
+		{name: "odt", content: testZip(t, "mimetype", "content.xml"), expectedMIME: "application/vnd.oasis.opendocument.text", expectedExt: ".odt"},
+		{name: "plain text", content: []byte("just some text"), expectedMIME: "text/plain; charset=utf-8", expectedExt: ".txt"},
+	}
+
+	registry := NewFileTypeRegistry()
+
+	for _, entry := range detectTests {
+		fileType := registry.Detect(entry.content)
+
+		if fileType.MIME != entry.expectedMIME || fileType.Extension != entry.expectedExt {
+			t.Errorf("%s: expected %s (%s), but got %s (%s)", entry.name, entry.expectedMIME, entry.expectedExt, fileType.MIME, fileType.Extension)
+		}
+	}
+}
+
+func TestFileTypeRegistry_Register(t *testing.T) {
+	registry := NewFileTypeRegistry()
+
+	registry.RegisterSignature(FileType{MIME: "application/x-custom", Extension: ".cst"}, 2, []byte("CUSTOM"))
+
+	if fileType := registry.Detect([]byte("..CUSTOM data")); fileType.MIME != "application/x-custom" {
+		t.Errorf("expected the registered type to be detected, but got %s", fileType.MIME)
+	}
+
+	// a newer registration takes precedence over the built in png signature
+	registry.Register(FileType{MIME: "image/x-special-png", Extension: ".png"}, func(buf []byte) bool {
+		return bytes.HasPrefix(buf, []byte("\x89PNG"))
+	})
+
+	if fileType := registry.Detect(testPNG(t, 2, 2)); fileType.MIME != "image/x-special-png" {
+		t.Errorf("expected the newer registration to win, but got %s", fileType.MIME)
+	}
+
+	var empty FileTypeRegistry
+	if fileType := empty.Detect(testPNG(t, 2, 2)); fileType.MIME != "image/png" {
+		t.Errorf("expected the empty registry to fall back to http.DetectContentType, but got %s", fileType.MIME)
+	}
+}
+
+func TestTools_UploadFilesDetectedType(t *testing.T) {
+	docx := "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+	var store MemoryStorage
+	testTools := Tools{Storage: &store, AllowedFileTypes: []string{docx, "text/plain"}}
+
+	request := newUploadRequest(t,
+		testPart{field: "file", fileName: "report.docx", content: testZip(t, "[Content_Types].xml", "word/document.xml")},
+		testPart{field: "file", fileName: "notes.txt", content: []byte("some notes")},
+	)
+
+	uploadedFiles, err := testTools.UploadFilesStream(request, "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFiles[0].DetectedType != docx || uploadedFiles[0].DetectedExtension != ".docx" {
+		t.Errorf("wrong detected type for docx: %s (%s)", uploadedFiles[0].DetectedType, uploadedFiles[0].DetectedExtension)
+	}
+
+	if uploadedFiles[1].DetectedType != "text/plain; charset=utf-8" {
+		t.Errorf("wrong detected type for text: %s", uploadedFiles[1].DetectedType)
+	}
+
+	request = newUploadRequest(t, testPart{field: "file", fileName: "archive.zip", content: testZip(t, "readme.txt")})
+
+	if _, err := testTools.UploadFilesStream(request, "uploads"); err == nil {
+		t.Error("a plain zip file should not be allowed as docx")
+	}
+}
+
+var extensionPolicyTests = []struct {
+	name          string
+	policy        ExtensionPolicy
+	fileName      string
+	contentType   string
+	content       []byte
+	renameFile    bool
+	expectedName  string
+	expectedExt   string
+	errorExpected bool
+}{
+	{name: "keep mismatch", policy: ExtensionKeep, fileName: "evil.html", contentType: "text/html", content: []byte("\x89PNG\r\n\x1a\n"), expectedName: "evil.html"},
+	{name: "reject mismatch", policy: ExtensionReject, fileName: "evil.html", content: []byte("\x89PNG\r\n\x1a\n"), errorExpected: true},
+	{name: "reject content type", policy: ExtensionReject, fileName: "img.png", contentType: "text/html", content: []byte("\x89PNG\r\n\x1a\n"), errorExpected: true},
+	{name: "reject alias allowed", policy: ExtensionReject, fileName: "photo.JPEG", contentType: "image/jpeg", content: []byte{0xFF, 0xD8, 0xFF, 0xE0}, expectedName: "photo.JPEG"},
+	{name: "reject renamed uses detected", policy: ExtensionReject, fileName: "photo.jpeg", content: []byte{0xFF, 0xD8, 0xFF, 0xE0}, renameFile: true, expectedExt: ".jpg"},
+	{name: "reject text formats", policy: ExtensionReject, fileName: "data.csv", contentType: "text/csv", content: []byte("a,b\n1,2\n"), expectedName: "data.csv"},
+	{name: "reject json", policy: ExtensionReject, fileName: "data.json", contentType: "application/json", content: []byte(`{"a": 1}`), expectedName: "data.json"},
+	{name: "reject ndjson", policy: ExtensionReject, fileName: "data.ndjson", contentType: "application/x-ndjson", content: []byte("{\"a\": 1}\n{\"a\": 2}\n"), expectedName: "data.ndjson"},
+	{name: "reject yaml", policy: ExtensionReject, fileName: "config.yaml", contentType: "application/yaml", content: []byte("a: 1\n"), expectedName: "config.yaml"},
+	{name: "reject svg", policy: ExtensionReject, fileName: "logo.svg", contentType: "image/svg+xml", content: []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`), expectedName: "logo.svg"},
+	{name: "reject text declared as image", policy: ExtensionReject, fileName: "data.json", contentType: "image/png", content: []byte(`{"a": 1}`), errorExpected: true},
+	{name: "reject xml as svg", policy: ExtensionReject, fileName: "logo.png", contentType: "image/svg+xml", content: []byte(`<?xml version="1.0"?><svg></svg>`), errorExpected: true},
+	{name: "correct mismatch", policy: ExtensionCorrect, fileName: "evil.html", content: []byte("\x89PNG\r\n\x1a\n"), expectedName: "evil.png"},
+	{name: "correct unknown type", policy: ExtensionCorrect, fileName: "evil.html", content: []byte{0x00, 0x01, 0x02, 0x03}, expectedName: "evil"},
+	{name: "correct renamed", policy: ExtensionCorrect, fileName: "picture", content: []byte("\x89PNG\r\n\x1a\n"), renameFile: true, expectedExt: ".png"},
+}
+
+func TestTools_UploadFilesExtensionPolicy(t *testing.T) {
+	for _, entry := range extensionPolicyTests {
+		testTools := Tools{Storage: &MemoryStorage{}, ExtensionPolicy: entry.policy}
+
+		request := newUploadRequest(t, testPart{field: "file", fileName: entry.fileName, contentType: entry.contentType, content: entry.content})
+
+		uploadedFiles, err := testTools.UploadFilesStream(request, "uploads", entry.renameFile)
+
+		if entry.errorExpected {
+			if !errors.Is(err, ErrExtensionMismatch) {
+				t.Errorf("%s: expected ErrExtensionMismatch, but got %v", entry.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but one received: %s", entry.name, err)
+			continue
+		}
+
+		name := uploadedFiles[0].NewFileName
+
+		if entry.expectedName != "" && name != entry.expectedName {
+			t.Errorf("%s: expected file to be saved as %s, but got %s", entry.name, entry.expectedName, name)
+		}
+
+		if entry.expectedExt != "" && filepath.Ext(name) != entry.expectedExt {
+			t.Errorf("%s: expected extension %s, but got %s", entry.name, entry.expectedExt, name)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package toolkit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+)
+
+const defaultMaxFormValuesSize = 10 << 20
+
+// UploadResult holds what UploadForm read from a multipart form: the uploaded files, in the order they
+// were sent, and the values of the other fields
+type UploadResult struct {
+	Files  []*UploadedFile
+	Values url.Values
+}
+
+func (t *Tools) maxFormValuesSize() int64 {
+	if t.MaxFormValuesSize > 0 {
+		return int64(t.MaxFormValuesSize)
+	}
+	return defaultMaxFormValuesSize
+}
+
+// UploadForm uploads the files in the request like UploadFilesStream does, in a single pass over the body,
+// keeping the values of the fields that are not files instead of skipping them. The values of all the fields
+// together may not go over MaxFormValuesSize
+func (t *Tools) UploadForm(r *http.Request, uploadDir string, rename ...bool) (*UploadResult, error) {
+	renameFile := shouldRenameFile(rename...)
+
+	if t.Storage == nil {
+		err := t.CreateDirIfNotExists(uploadDir)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reader, err := r.MultipartReader()
+
+	if err != nil {
+		return nil, multipartError(err)
+	}
+
+	u := &upload{t: t, ctx: r.Context(), tenant: t.quotaTenant(r), uploadDir: uploadDir, renameFile: renameFile, total: r.ContentLength}
+
+	values := make(url.Values)
+
+	// as with UploadFilesStream, the files saved before an error are returned with it
+	uploadedFiles, err := u.stream(reader, values)
+
+	return &UploadResult{Files: uploadedFiles, Values: values}, err
+}
+
+// Decode sets the fields of the struct pointed to by v from the form values. Each field is read from the
+// form field named in its `form` tag, or from the one with the same name as the field when it has none,
+// and fields tagged `form:"-"` are skipped. Strings, booleans, numbers and slices of them are supported.
+// Values that cannot be parsed are reported with a *FieldError
+func (res *UploadResult) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("decode target must be a pointer to a struct")
+	}
+	rv = rv.Elem()
+
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Tag.Get("form")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		values, ok := res.Values[name]
+		if !ok || len(values) == 0 {
+			continue
+		}
+
+		fv := rv.Field(i)
+
+		if fv.Kind() == reflect.Slice {
+			slice := reflect.MakeSlice(fv.Type(), len(values), len(values))
+			for j, value := range values {
+				if err := setFormValue(slice.Index(j), value); err != nil {
+					return &FieldError{Field: name, Err: err}
+				}
+			}
+			fv.Set(slice)
+			continue
+		}
+
+		if err := setFormValue(fv, values[0]); err != nil {
+			return &FieldError{Field: name, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// setFormValue parses value into v according to its kind
+func setFormValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package toolkit
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestTools_UploadForm(t *testing.T) {
+	testTools := Tools{Storage: &MemoryStorage{}}
+
+	request := newUploadRequest(t,
+		testPart{field: "title", content: []byte("holiday")},
+		testPart{field: "photo", fileName: "beach.png", content: testPNG(t, 4, 4)},
+		testPart{field: "tags", content: []byte("sea")},
+		testPart{field: "tags", content: []byte("sun")},
+		testPart{field: "count", content: []byte("2")},
+		testPart{field: "public", content: []byte("true")},
+	)
+
+	result, err := testTools.UploadForm(request, "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Files) != 1 || result.Files[0].FieldName != "photo" || result.Files[0].OriginalFileName != "beach.png" {
+		t.Errorf("wrong files returned: %+v", result.Files)
+	}
+
+	if result.Values.Get("title") != "holiday" || len(result.Values["tags"]) != 2 {
+		t.Errorf("wrong values returned: %v", result.Values)
+	}
+
+	var form struct {
+		Title  string   `form:"title"`
+		Tags   []string `form:"tags"`
+		Count  int      `form:"count"`
+		Public bool     `form:"public"`
+		Ignore string   `form:"-"`
+	}
+
+	if err := result.Decode(&form); err != nil {
+		t.Fatal(err)
+	}
+
+	if form.Title != "holiday" || len(form.Tags) != 2 || form.Tags[1] != "sun" || form.Count != 2 || !form.Public {
+		t.Errorf("wrong decoded form: %+v", form)
+	}
+
+	var badForm struct {
+		Title int `form:"title"`
+	}
+
+	var fieldErr *FieldError
+	if err := result.Decode(&badForm); !errors.As(err, &fieldErr) || fieldErr.Field != "title" {
+		t.Errorf("expected a *FieldError for title, but got %v", err)
+	}
+
+	if err := result.Decode(form); err == nil {
+		t.Error("expected an error when decoding into a non pointer")
+	}
+}
+
+func TestTools_UploadFormValuesLimit(t *testing.T) {
+	testTools := Tools{Storage: &MemoryStorage{}, MaxFormValuesSize: 100}
+
+	request := newUploadRequest(t,
+		testPart{field: "first", content: bytes.Repeat([]byte("a"), 60)},
+		testPart{field: "second", content: bytes.Repeat([]byte("b"), 60)},
+	)
+
+	if _, err := testTools.UploadForm(request, "uploads"); !errors.Is(err, ErrRequestTooLarge) {
+		t.Errorf("expected ErrRequestTooLarge, but got %v", err)
+	}
+}
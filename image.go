@@ -0,0 +1,364 @@
+package toolkit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	defaultMaxImagePixels = 50000000
+	defaultJPEGQuality    = 90
+)
+
+// ErrImageTooLarge is returned when an uploaded image goes over the limits in ImageOptions
+var ErrImageTooLarge = errors.New("the uploaded image is too large")
+
+// ImageOptions configures the processing of uploaded images. Only the formats the standard library can
+// decode, jpeg, png and gif, are processed; other files, images included, are left alone
+type ImageOptions struct {
+	// MaxWidth and MaxHeight are the largest dimensions accepted, in pixels. Zero means no limit
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels is the largest width times height accepted. It is checked from the image header, before
+	// the image is decoded, to stop decompression bombs. The frames of an animated GIF that StripMetadata
+	// re-encodes are counted together. It defaults to 50 million
+	MaxPixels int
+	// StripMetadata re-encodes images, which drops EXIF and any other metadata they carry. Note that
+	// the EXIF orientation goes away too
+	StripMetadata bool
+	// JPEGQuality is the quality used to encode jpeg images and thumbnails. It defaults to 90
+	JPEGQuality int
+	// Thumbnails are the thumbnails generated for each image
+	Thumbnails []ThumbnailSize
+}
+
+// ThumbnailSize is the box a thumbnail is scaled to fit in, keeping the aspect ratio of the image. When
+// either dimension is zero, only the other one limits the thumbnail. Images are never scaled up
+type ThumbnailSize struct {
+	Width  int
+	Height int
+}
+
+// isProcessableImage reports whether the detected type is an image format ImageOptions applies to
+func isProcessableImage(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// processImage checks the dimensions of the image saved under key, re-encodes it when metadata must be
+// stripped, and saves its thumbnails next to it
+func (u *upload) processImage(key string, uploadedFile *UploadedFile) error {
+	t, opts := u.t, u.t.Images
+
+	obj, err := t.storage().Get(key)
+	if err != nil {
+		return err
+	}
+	config, format, err := image.DecodeConfig(obj)
+	obj.Close()
+	if err != nil {
+		return fmt.Errorf("the uploaded image could not be decoded: %w", err)
+	}
+
+	maxPixels := opts.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = defaultMaxImagePixels
+	}
+
+	if (opts.MaxWidth > 0 && config.Width > opts.MaxWidth) ||
+		(opts.MaxHeight > 0 && config.Height > opts.MaxHeight) ||
+		config.Width*config.Height > maxPixels {
+		return fmt.Errorf("%w: %q is %dx%d", ErrImageTooLarge, uploadedFile.OriginalFileName, config.Width, config.Height)
+	}
+
+	uploadedFile.Width, uploadedFile.Height = config.Width, config.Height
+
+	if !opts.StripMetadata && len(opts.Thumbnails) == 0 {
+		return nil
+	}
+
+	// every frame of an animated GIF is decoded to be kept, so they all count towards MaxPixels.
+	// Thumbnails alone only need the first frame, which image.Decode reads
+	decodeAll := format == "gif" && opts.StripMetadata
+	if decodeAll {
+		obj, err = t.storage().Get(key)
+		if err != nil {
+			return err
+		}
+		frames, err := gifFrameCount(obj)
+		obj.Close()
+		if err != nil {
+			return fmt.Errorf("the uploaded image could not be decoded: %w", err)
+		}
+		if frames*config.Width*config.Height > maxPixels {
+			return fmt.Errorf("%w: %q has %d frames of %dx%d", ErrImageTooLarge, uploadedFile.OriginalFileName, frames, config.Width, config.Height)
+		}
+	}
+
+	obj, err = t.storage().Get(key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	var img image.Image
+	var animation *gif.GIF
+
+	if decodeAll {
+		animation, err = gif.DecodeAll(obj)
+		if err == nil {
+			img = animation.Image[0]
+		}
+	} else {
+		img, _, err = image.Decode(obj)
+	}
+	if err != nil {
+		return fmt.Errorf("the uploaded image could not be decoded: %w", err)
+	}
+
+	if opts.StripMetadata {
+		buf := new(bytes.Buffer)
+
+		if animation != nil {
+			err = gif.EncodeAll(buf, animation)
+		} else {
+			err = encodeImage(buf, img, format, opts.JPEGQuality)
+		}
+		if err != nil {
+			return err
+		}
+
+		info, err := t.storage().Put(key, buf)
+		if err != nil {
+			return err
+		}
+		uploadedFile.FileSize = info.Size
+		uploadedFile.ETag = info.ETag
+	}
+
+	for _, size := range opts.Thumbnails {
+		width, height := thumbnailDimensions(config.Width, config.Height, size)
+
+		buf := new(bytes.Buffer)
+		if err := encodeImage(buf, scaleImage(img, width, height), format, opts.JPEGQuality); err != nil {
+			return err
+		}
+
+		thumbnail := &UploadedFile{
+			NewFileName:       thumbnailName(uploadedFile.NewFileName, width, height),
+			OriginalFileName:  uploadedFile.OriginalFileName,
+			DetectedType:      uploadedFile.DetectedType,
+			DetectedExtension: uploadedFile.DetectedExtension,
+			Width:             width,
+			Height:            height,
+		}
+
+		if err := u.saveDerived(thumbnail, buf); err != nil {
+			return err
+		}
+		uploadedFile.Thumbnails = append(uploadedFile.Thumbnails, thumbnail)
+	}
+
+	return nil
+}
+
+// encodeImage writes img to w in format, one of the formats image.DecodeConfig reports
+func encodeImage(w io.Writer, img image.Image, format string, quality int) error {
+	switch format {
+	case "jpeg":
+		if quality <= 0 {
+			quality = defaultJPEGQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return png.Encode(w, img)
+	}
+}
+
+// thumbnailName returns the name of the thumbnail of width x height of the image named name
+func thumbnailName(name string, width, height int) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s_%dx%d%s", strings.TrimSuffix(name, ext), width, height, ext)
+}
+
+// thumbnailKeys returns the keys of the thumbnails Images makes of the image stored under key, or nothing
+// when it is not an image
+func (t *Tools) thumbnailKeys(key string) []string {
+	if t.Images == nil || len(t.Images.Thumbnails) == 0 {
+		return nil
+	}
+
+	obj, err := t.storage().Get(key)
+	if err != nil {
+		return nil
+	}
+	config, _, err := image.DecodeConfig(obj)
+	obj.Close()
+	if err != nil {
+		return nil
+	}
+
+	var keys []string
+	for _, size := range t.Images.Thumbnails {
+		width, height := thumbnailDimensions(config.Width, config.Height, size)
+		keys = append(keys, thumbnailName(key, width, height))
+	}
+	return keys
+}
+
+// thumbnailDimensions returns the size of an image of width x height scaled to fit in size
+func thumbnailDimensions(width, height int, size ThumbnailSize) (int, int) {
+	scale := 1.0
+
+	if size.Width > 0 && width > size.Width {
+		scale = float64(size.Width) / float64(width)
+	}
+	if size.Height > 0 && float64(height)*scale > float64(size.Height) {
+		scale = float64(size.Height) / float64(height)
+	}
+
+	w, h := int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// scaleImage resizes src to width x height, averaging the source pixels that fall in each destination
+// pixel, which gives smooth results when scaling down
+func scaleImage(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	if bounds.Dx() == width && bounds.Dy() == height {
+		return src
+	}
+
+	rgba := image.NewRGBA(bounds)
+	draw.Draw(rgba, bounds, src, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := rgba.RGBAAt(sx, sy)
+					r, g, b, a = r+uint32(c.R), g+uint32(c.G), b+uint32(c.B), a+uint32(c.A)
+					n++
+				}
+			}
+
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+
+	return dst
+}
+
+// gifFrameCount counts the frames of the GIF read from r by walking its blocks, without decompressing them
+func gifFrameCount(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, err
+	}
+	if string(header[:3]) != "GIF" {
+		return 0, errors.New("gif: not a GIF file")
+	}
+	if err := skipColorTable(br, header[10]); err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch introducer {
+		case 0x21: // extension: a label, then sub-blocks
+			if _, err := br.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return 0, err
+			}
+		case 0x2C: // image descriptor, an optional color table, the LZW code size and the image data
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return 0, err
+			}
+			if err := skipColorTable(br, descriptor[8]); err != nil {
+				return 0, err
+			}
+			if _, err := br.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return 0, err
+			}
+			frames++
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("gif: unknown block type 0x%02x", introducer)
+		}
+	}
+}
+
+// skipColorTable skips the color table that follows a GIF block whose packed fields are flags
+func skipColorTable(br *bufio.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	_, err := br.Discard(3 * (1 << (flags&0x07 + 1)))
+	return err
+}
+
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := br.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package toolkit
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"testing"
+)
+
+// testJPEGWithExif returns a jpeg image carrying an EXIF segment
+func testJPEGWithExif(t *testing.T) []byte {
+	t.Helper()
+
+	img, _, err := image.Decode(bytes.NewReader(testPNG(t, 40, 30)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	exif := []byte("Exif\x00\x00MM\x00*\x00\x00\x00\x08GPS data here")
+	segment := append([]byte{0xFF, 0xE1, 0x00, byte(len(exif) + 2)}, exif...)
+
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+func TestTools_UploadFilesImageLimits(t *testing.T) {
+	var limitTests = []struct {
+		name          string
+		options       ImageOptions
+		errorExpected bool
+	}{
+		{name: "within limits", options: ImageOptions{MaxWidth: 100, MaxHeight: 50, MaxPixels: 5000}, errorExpected: false},
+		{name: "too wide", options: ImageOptions{MaxWidth: 99}, errorExpected: true},
+		{name: "too high", options: ImageOptions{MaxHeight: 49}, errorExpected: true},
+		{name: "too many pixels", options: ImageOptions{MaxPixels: 4999}, errorExpected: true},
+	}
+
+	for _, entry := range limitTests {
+		var store MemoryStorage
+		options := entry.options
+		testTools := Tools{Storage: &store, Images: &options}
+
+		request := newUploadRequest(t, testPart{field: "file", fileName: "img.png", content: testPNG(t, 100, 50)})
+
+		uploadedFiles, err := testTools.UploadFilesStream(request, "uploads")
+		saved, _ := store.List("uploads/")
+
+		if entry.errorExpected {
+			if !errors.Is(err, ErrImageTooLarge) {
+				t.Errorf("%s: expected ErrImageTooLarge, but got %v", entry.name, err)
+			}
+			if len(saved) != 0 {
+				t.Errorf("%s: image over the limits should not be kept", entry.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but one received: %s", entry.name, err)
+			continue
+		}
+
+		if uploadedFiles[0].Width != 100 || uploadedFiles[0].Height != 50 {
+			t.Errorf("%s: wrong dimensions reported: %dx%d", entry.name, uploadedFiles[0].Width, uploadedFiles[0].Height)
+		}
+	}
+}
+
+func TestTools_UploadFilesStripMetadata(t *testing.T) {
+	var store MemoryStorage
+	testTools := Tools{Storage: &store, Images: &ImageOptions{StripMetadata: true}}
+
+	content := testJPEGWithExif(t)
+	request := newUploadRequest(t, testPart{field: "file", fileName: "photo.jpg", content: content})
+
+	uploadedFiles, err := testTools.UploadFiles(request, "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := store.Get(uploadedFiles[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(obj)
+
+	if bytes.Contains(stored, []byte("Exif")) {
+		t.Error("EXIF metadata was not stripped")
+	}
+
+	if uploadedFiles[0].FileSize != int64(len(stored)) {
+		t.Errorf("reported size %d differs from the stored size %d", uploadedFiles[0].FileSize, len(stored))
+	}
+
+	if _, err := jpeg.Decode(bytes.NewReader(stored)); err != nil {
+		t.Error("stored image is not a valid jpeg:", err)
+	}
+}
+
+func TestTools_UploadFilesThumbnails(t *testing.T) {
+	for _, transactional := range []bool{false, true} {
+		var store MemoryStorage
+		testTools := Tools{
+			Storage:              &store,
+			TransactionalUploads: transactional,
+			Images: &ImageOptions{Thumbnails: []ThumbnailSize{
+				{Width: 40},
+				{Height: 10},
+				{Width: 500, Height: 500},
+			}},
+		}
+
+		request := newUploadRequest(t, testPart{field: "file", fileName: "wide.png", content: testPNG(t, 100, 50)})
+
+		uploadedFiles, err := testTools.UploadFilesStream(request, "uploads", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []struct {
+			name          string
+			width, height int
+		}{
+			{"wide_40x20.png", 40, 20},
+			{"wide_20x10.png", 20, 10},
+			{"wide_100x50.png", 100, 50},
+		}
+
+		thumbnails := uploadedFiles[0].Thumbnails
+		if len(thumbnails) != len(expected) {
+			t.Fatalf("expected %d thumbnails, but got %d", len(expected), len(thumbnails))
+		}
+
+		for i, thumbnail := range thumbnails {
+			if thumbnail.NewFileName != expected[i].name {
+				t.Errorf("transactional %t: expected thumbnail %s, but got %s", transactional, expected[i].name, thumbnail.NewFileName)
+			}
+
+			obj, err := store.Get(thumbnail.Key)
+			if err != nil {
+				t.Errorf("transactional %t: thumbnail %s was not saved: %s", transactional, thumbnail.Key, err)
+				continue
+			}
+
+			config, _, err := image.DecodeConfig(obj)
+			if err != nil || config.Width != expected[i].width || config.Height != expected[i].height {
+				t.Errorf("transactional %t: wrong thumbnail %s: %dx%d %v", transactional, thumbnail.NewFileName, config.Width, config.Height, err)
+			}
+		}
+
+		saved, _ := store.List("uploads/")
+		if len(saved) != 4 {
+			t.Errorf("transactional %t: expected the image and 3 thumbnails to be saved, but found %d files", transactional, len(saved))
+		}
+	}
+}
+
+func TestTools_UploadFilesAnimatedGIFLimits(t *testing.T) {
+	animation := &gif.GIF{}
+	for i := 0; i < 10; i++ {
+		animation.Image = append(animation.Image, image.NewPaletted(image.Rect(0, 0, 10, 10), color.Palette{color.Black, color.White}))
+		animation.Delay = append(animation.Delay, 10)
+	}
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, animation); err != nil {
+		t.Fatal(err)
+	}
+
+	if frames, err := gifFrameCount(bytes.NewReader(buf.Bytes())); err != nil || frames != 10 {
+		t.Fatalf("expected 10 frames, but got %d: %v", frames, err)
+	}
+
+	var frameTests = []struct {
+		name          string
+		options       ImageOptions
+		errorExpected bool
+	}{
+		{name: "all frames within limits", options: ImageOptions{MaxPixels: 1000, StripMetadata: true}, errorExpected: false},
+		{name: "too many frames", options: ImageOptions{MaxPixels: 999, StripMetadata: true}, errorExpected: true},
+		{name: "thumbnails read the first frame", options: ImageOptions{MaxPixels: 100, Thumbnails: []ThumbnailSize{{Width: 5, Height: 5}}}, errorExpected: false},
+	}
+
+	for _, entry := range frameTests {
+		options := entry.options
+		testTools := Tools{Storage: &MemoryStorage{}, Images: &options}
+
+		request := newUploadRequest(t, testPart{field: "file", fileName: "anim.gif", content: buf.Bytes()})
+		_, err := testTools.UploadFiles(request, "uploads")
+
+		if entry.errorExpected && !errors.Is(err, ErrImageTooLarge) {
+			t.Errorf("%s: expected ErrImageTooLarge, but got %v", entry.name, err)
+		}
+		if !entry.errorExpected && err != nil {
+			t.Errorf("%s: error not expected, but one received: %s", entry.name, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package toolkit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+)
+
+// formFile is a file part of a multipart body, read before any file of the request is saved. It is kept
+// in memory, in a temporary file once the files of the request no longer fit in memory, or in a form
+// that was parsed before the upload
+type formFile struct {
+	field    string
+	fileName string
+	header   textproto.MIMEHeader
+	size     int64
+	// position is the index of the file among the file parts of the request
+	position int
+	content  []byte
+	tmpFile  string
+	fh       *multipart.FileHeader
+}
+
+func (f *formFile) open() (io.ReadCloser, error) {
+	switch {
+	case f.fh != nil:
+		return f.fh.Open()
+	case f.tmpFile != "":
+		return os.Open(f.tmpFile)
+	default:
+		return io.NopCloser(bytes.NewReader(f.content)), nil
+	}
+}
+
+// readForm reads the multipart body of the request in a single pass, returning its files in the order
+// they appear and the values of the other fields. Like http.Request.ParseMultipartForm, files are kept in
+// memory up to maxMemory bytes in total, and spooled to temporary files past that, which removeFormFiles
+// deletes. The values may not go over MaxFormValuesSize; the size limits of the files are checked as they
+// are saved
+func (u *upload) readForm(reader *multipart.Reader, maxMemory int64) (files []*formFile, values url.Values, err error) {
+	values = make(url.Values)
+	var valuesSize, filesSize int64
+
+	defer func() {
+		if err != nil {
+			removeFormFiles(files)
+			files = nil
+		}
+	}()
+
+	for {
+		if err := u.ctx.Err(); err != nil {
+			return files, nil, err
+		}
+
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return files, values, nil
+		}
+		if err != nil {
+			return files, nil, multipartError(err)
+		}
+
+		if part.FileName() == "" {
+			limit := u.t.maxFormValuesSize() - valuesSize
+			value, err := io.ReadAll(io.LimitReader(part, limit+1))
+			part.Close()
+			if err != nil {
+				return files, nil, multipartError(err)
+			}
+			if int64(len(value)) > limit {
+				return files, nil, fmt.Errorf("%w: the form values are over %d bytes", ErrRequestTooLarge, u.t.maxFormValuesSize())
+			}
+
+			valuesSize += int64(len(value))
+			values.Add(part.FormName(), string(value))
+			continue
+		}
+
+		f := &formFile{field: part.FormName(), fileName: part.FileName(), header: part.Header, position: len(files)}
+		files = append(files, f)
+
+		err = u.spoolPart(f, part, maxMemory-filesSize)
+		part.Close()
+		if err != nil {
+			return files, nil, err
+		}
+
+		filesSize += f.size
+	}
+}
+
+// spoolPart reads part into f, in memory when it is no bigger than memory bytes and in a temporary file
+// otherwise
+func (u *upload) spoolPart(f *formFile, part io.Reader, memory int64) error {
+	var buf bytes.Buffer
+
+	if memory > 0 {
+		n, err := io.CopyN(&buf, part, memory+1)
+		if err != nil && err != io.EOF {
+			return multipartError(err)
+		}
+		if n <= memory {
+			f.content, f.size = buf.Bytes(), n
+			return nil
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "toolkit-multipart-*")
+	if err != nil {
+		return err
+	}
+	f.tmpFile = tmp.Name()
+
+	n, err := io.Copy(tmp, io.MultiReader(&buf, part))
+	if closeErr := tmp.Close(); err == nil && closeErr != nil {
+		return closeErr
+	}
+	if err != nil {
+		return multipartError(err)
+	}
+
+	f.size = n
+	return nil
+}
+
+// removeFormFiles deletes the temporary files files were spooled to
+func removeFormFiles(files []*formFile) {
+	for _, f := range files {
+		if f.tmpFile != "" {
+			os.Remove(f.tmpFile)
+		}
+	}
+}
+
+// parsedFormFiles lists the files of a form parsed before the upload. The order of the fields is lost by
+// then, so they come sorted by field, the files of each field in the order they were sent
+func parsedFormFiles(form *multipart.Form) []*formFile {
+	fields := make([]string, 0, len(form.File))
+	for field := range form.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var files []*formFile
+	for _, field := range fields {
+		for _, fh := range form.File[field] {
+			files = append(files, &formFile{field: field, fileName: fh.Filename, header: fh.Header, size: fh.Size, position: len(files), fh: fh})
+		}
+	}
+	return files
+}
@@ -0,0 +1,348 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrQuotaExceeded is returned when an upload would take a tenant over its quota
+var ErrQuotaExceeded = errors.New("the upload quota is exceeded")
+
+// Quota is the most a tenant may store. Zero values mean no limit
+type Quota struct {
+	MaxBytes int64
+	MaxFiles int64
+}
+
+// QuotaUsage is what a tenant stores, along with its quota
+type QuotaUsage struct {
+	Bytes int64
+	Files int64
+	Quota Quota
+}
+
+// QuotaStore keeps track of the bytes and files stored by each tenant
+type QuotaStore interface {
+	// Usage returns what tenant stores and its quota
+	Usage(tenant string) (QuotaUsage, error)
+	// Reserve adds bytes and files to what tenant stores. When that would go over its quota, nothing is
+	// added and ErrQuotaExceeded is returned
+	Reserve(tenant string, bytes, files int64) error
+	// Release takes bytes and files off what tenant stores
+	Release(tenant string, bytes, files int64) error
+}
+
+// quotaUsages is the usage of every tenant, which both QuotaStore implementations keep
+type quotaUsages map[string]tenantUsage
+
+type tenantUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+func (q quotaUsages) usage(tenant string, quotas map[string]Quota, defaultQuota Quota) QuotaUsage {
+	usage := QuotaUsage{Bytes: q[tenant].Bytes, Files: q[tenant].Files, Quota: defaultQuota}
+	if quota, ok := quotas[tenant]; ok {
+		usage.Quota = quota
+	}
+	return usage
+}
+
+func (q quotaUsages) reserve(tenant string, bytes, files int64, quotas map[string]Quota, defaultQuota Quota) error {
+	usage := q.usage(tenant, quotas, defaultQuota)
+	if err := usage.check(bytes, files); err != nil {
+		return err
+	}
+	q[tenant] = tenantUsage{Bytes: usage.Bytes + bytes, Files: usage.Files + files}
+	return nil
+}
+
+func (q quotaUsages) release(tenant string, bytes, files int64) {
+	usage := q[tenant]
+	usage.Bytes -= bytes
+	usage.Files -= files
+	if usage.Bytes < 0 {
+		usage.Bytes = 0
+	}
+	if usage.Files < 0 {
+		usage.Files = 0
+	}
+	q[tenant] = usage
+}
+
+// check fails when adding bytes and files would go over the quota
+func (u QuotaUsage) check(bytes, files int64) error {
+	if u.Quota.MaxFiles > 0 && u.Files+files > u.Quota.MaxFiles {
+		return fmt.Errorf("%w: at most %d files allowed", ErrQuotaExceeded, u.Quota.MaxFiles)
+	}
+	if u.Quota.MaxBytes > 0 && u.Bytes+bytes > u.Quota.MaxBytes {
+		return fmt.Errorf("%w: at most %d bytes allowed", ErrQuotaExceeded, u.Quota.MaxBytes)
+	}
+	return nil
+}
+
+// MemoryQuotaStore is a QuotaStore that keeps usage in memory, so it is lost when the program exits.
+// Its zero value is ready to use, with no limits
+type MemoryQuotaStore struct {
+	// Quotas are the quotas of the tenants that have one of their own, and DefaultQuota the quota of
+	// the others
+	Quotas       map[string]Quota
+	DefaultQuota Quota
+
+	mu     sync.Mutex
+	usages quotaUsages
+}
+
+func (s *MemoryQuotaStore) Usage(tenant string) (QuotaUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usages.usage(tenant, s.Quotas, s.DefaultQuota), nil
+}
+
+func (s *MemoryQuotaStore) Reserve(tenant string, bytes, files int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.usages == nil {
+		s.usages = make(quotaUsages)
+	}
+	return s.usages.reserve(tenant, bytes, files, s.Quotas, s.DefaultQuota)
+}
+
+func (s *MemoryQuotaStore) Release(tenant string, bytes, files int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.usages != nil {
+		s.usages.release(tenant, bytes, files)
+	}
+	return nil
+}
+
+// FileQuotaStore is a QuotaStore that keeps usage in a JSON file, so it survives restarts. The file is
+// read on every call and replaced on every change, so it must not be shared between processes
+type FileQuotaStore struct {
+	// Path is the file usage is kept in. It is created when it does not exist
+	Path string
+	// Quotas are the quotas of the tenants that have one of their own, and DefaultQuota the quota of
+	// the others
+	Quotas       map[string]Quota
+	DefaultQuota Quota
+
+	mu sync.Mutex
+}
+
+func (s *FileQuotaStore) Usage(tenant string) (QuotaUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usages, err := s.load()
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	return usages.usage(tenant, s.Quotas, s.DefaultQuota), nil
+}
+
+func (s *FileQuotaStore) Reserve(tenant string, bytes, files int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usages, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := usages.reserve(tenant, bytes, files, s.Quotas, s.DefaultQuota); err != nil {
+		return err
+	}
+	return s.save(usages)
+}
+
+func (s *FileQuotaStore) Release(tenant string, bytes, files int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usages, err := s.load()
+	if err != nil {
+		return err
+	}
+	usages.release(tenant, bytes, files)
+	return s.save(usages)
+}
+
+func (s *FileQuotaStore) load() (quotaUsages, error) {
+	usages := make(quotaUsages)
+
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return usages, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &usages); err != nil {
+		return nil, fmt.Errorf("reading quota usage from %s: %w", s.Path, err)
+	}
+	return usages, nil
+}
+
+// save replaces the file through a rename, so it is never seen half written
+func (s *FileQuotaStore) save(usages quotaUsages) error {
+	data, err := json.Marshal(usages)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// quotaTenant returns the tenant the files uploaded with r are counted against, or an empty string when
+// quotas do not apply
+func (t *Tools) quotaTenant(r *http.Request) string {
+	if t.Quotas == nil || t.QuotaKey == nil || r == nil {
+		return ""
+	}
+	return t.QuotaKey(r)
+}
+
+// checkQuota fails when storing bytes more in files more files would take tenant over its quota
+func (t *Tools) checkQuota(tenant string, bytes, files int64) (QuotaUsage, error) {
+	usage, err := t.Quotas.Usage(tenant)
+	if err != nil {
+		return usage, err
+	}
+	return usage, usage.check(bytes, files)
+}
+
+// reserveQuota counts an uploaded file against the quota of the tenant of the upload
+func (u *upload) reserveQuota(uploadedFile *UploadedFile) error {
+	if u.tenant == "" {
+		return nil
+	}
+
+	if err := u.t.Quotas.Reserve(u.tenant, uploadedFile.FileSize, 1); err != nil {
+		return err
+	}
+
+	if u.reserved == nil {
+		u.reserved = make(map[*UploadedFile]bool)
+	}
+	u.reserved[uploadedFile] = true
+	return nil
+}
+
+// releaseQuota gives back the quota taken by an uploaded file that is removed
+func (u *upload) releaseQuota(uploadedFile *UploadedFile) {
+	if u.reserved[uploadedFile] {
+		u.t.Quotas.Release(u.tenant, uploadedFile.FileSize, 1)
+		delete(u.reserved, uploadedFile)
+	}
+}
+
+// replacedFile is a stored file that a file of an upload replaces: a file saved earlier by the same upload,
+// whose reservation is given back, or one that was there before, whose size is
+type replacedFile struct {
+	file *UploadedFile
+	size int64
+}
+
+// replacing returns the file stored under key, which a file about to be written there replaces, or nil
+// when there is none or quotas do not apply
+func (u *upload) replacing(key string) *replacedFile {
+	if u.tenant == "" {
+		return nil
+	}
+
+	for f := range u.reserved {
+		if f.Key == key {
+			return &replacedFile{file: f}
+		}
+	}
+
+	info, err := u.t.storage().Stat(key)
+	if err != nil {
+		return nil
+	}
+	return &replacedFile{size: info.Size}
+}
+
+// replacedPending is replacing for the i-th pending file as it is committed, which replaces the last
+// file moved to the same key before it, or the file of size bytes that was stored there
+func (u *upload) replacedPending(i int, size int64) *replacedFile {
+	if u.tenant == "" {
+		return nil
+	}
+
+	for j := i - 1; j >= 0; j-- {
+		if p := u.pending[j]; p.moved && p.file.Key == u.pending[i].file.Key {
+			return &replacedFile{file: p.file}
+		}
+	}
+	return &replacedFile{size: size}
+}
+
+// releaseReplaced gives back the quota taken by a file that was replaced
+func (u *upload) releaseReplaced(replaced *replacedFile) {
+	switch {
+	case replaced == nil:
+	case replaced.file != nil:
+		u.releaseQuota(replaced.file)
+	default:
+		u.t.Quotas.Release(u.tenant, replaced.size, 1)
+	}
+}
+
+// DeleteFile deletes the file saved under key in Storage, along with the thumbnails Images makes of it, and
+// gives back the space they took to the quota of tenant. Pass an empty tenant when quotas are not used
+func (t *Tools) DeleteFile(tenant, key string) error {
+	info, err := t.storage().Stat(key)
+	if err != nil {
+		return err
+	}
+
+	// the thumbnails are found from the image, so before it is gone
+	thumbnails := t.thumbnailKeys(key)
+
+	if err := t.storage().Delete(key); err != nil {
+		return err
+	}
+
+	size, files := info.Size, int64(1)
+	for _, thumbnail := range thumbnails {
+		thumbnailInfo, err := t.storage().Stat(thumbnail)
+		if err != nil {
+			continue
+		}
+		if err := t.storage().Delete(thumbnail); err != nil {
+			return err
+		}
+		size += thumbnailInfo.Size
+		files++
+	}
+
+	if tenant != "" && t.Quotas != nil {
+		return t.Quotas.Release(tenant, size, files)
+	}
+	return nil
+}
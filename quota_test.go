@@ -0,0 +1,179 @@
+package toolkit
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func testQuotaStore(t *testing.T, s QuotaStore) {
+	t.Helper()
+
+	if err := s.Reserve("acme", 600, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Reserve("acme", 500, 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded over the byte quota, but got %v", err)
+	}
+
+	if err := s.Reserve("acme", 100, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Reserve("acme", 1, 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded over the file quota, but got %v", err)
+	}
+
+	if err := s.Reserve("big", 5000, 5); err != nil {
+		t.Errorf("expected the quota of the tenant to apply, but got %v", err)
+	}
+
+	if err := s.Release("acme", 600, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := s.Usage("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 100 || usage.Files != 1 || usage.Quota.MaxBytes != 1000 {
+		t.Errorf("wrong usage: %+v", usage)
+	}
+}
+
+func TestMemoryQuotaStore(t *testing.T) {
+	testQuotaStore(t, &MemoryQuotaStore{
+		DefaultQuota: Quota{MaxBytes: 1000, MaxFiles: 2},
+		Quotas:       map[string]Quota{"big": {MaxBytes: 10000}},
+	})
+}
+
+func TestFileQuotaStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	quotas := map[string]Quota{"big": {MaxBytes: 10000}}
+
+	testQuotaStore(t, &FileQuotaStore{Path: path, DefaultQuota: Quota{MaxBytes: 1000, MaxFiles: 2}, Quotas: quotas})
+
+	// usage survives a new store on the same file
+	usage, err := (&FileQuotaStore{Path: path}).Usage("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 100 || usage.Files != 1 {
+		t.Errorf("usage was not kept in the file: %+v", usage)
+	}
+}
+
+func TestTools_UploadFilesQuota(t *testing.T) {
+	var store MemoryStorage
+	quotas := &MemoryQuotaStore{DefaultQuota: Quota{MaxBytes: 250, MaxFiles: 3}}
+
+	testTools := Tools{
+		Storage:  &store,
+		Quotas:   quotas,
+		QuotaKey: func(r *http.Request) string { return r.Header.Get("X-Tenant") },
+	}
+
+	request := func(tenant string, sizes ...int) *http.Request {
+		var parts []testPart
+		for _, size := range sizes {
+			parts = append(parts, testPart{field: "file", fileName: "file.txt", content: bytes.Repeat([]byte("a"), size)})
+		}
+		r := newUploadRequest(t, parts...)
+		r.Header.Set("X-Tenant", tenant)
+		return r
+	}
+
+	uploadedFiles, err := testTools.UploadFiles(request("acme", 100, 100), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testTools.UploadFiles(request("acme", 100), "acme"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("UploadFiles: expected ErrQuotaExceeded, but got %v", err)
+	}
+
+	if _, err := testTools.UploadFilesStream(request("acme", 100), "acme"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("UploadFilesStream: expected ErrQuotaExceeded, but got %v", err)
+	}
+
+	if saved, _ := store.List("acme/"); len(saved) != 2 {
+		t.Errorf("expected the rejected files not to be saved, but found %d files", len(saved))
+	}
+
+	if usage, _ := quotas.Usage("acme"); usage.Bytes != 200 || usage.Files != 2 {
+		t.Errorf("wrong usage after uploads: %+v", usage)
+	}
+
+	if _, err := testTools.UploadFiles(request("other", 200), "other"); err != nil {
+		t.Errorf("expected other tenants not to be affected, but got %v", err)
+	}
+
+	if err := testTools.DeleteFile("acme", uploadedFiles[0].Key); err != nil {
+		t.Fatal(err)
+	}
+
+	if usage, _ := quotas.Usage("acme"); usage.Bytes != 100 || usage.Files != 1 {
+		t.Errorf("wrong usage after delete: %+v", usage)
+	}
+
+	if _, err := testTools.UploadFilesStream(request("acme", 100), "acme"); err != nil {
+		t.Errorf("expected the deleted space to be available again, but got %v", err)
+	}
+}
+
+func TestTools_UploadFilesQuotaDerivedAndReplaced(t *testing.T) {
+	for _, transactional := range []bool{false, true} {
+		var store MemoryStorage
+		quotas := &MemoryQuotaStore{}
+
+		testTools := Tools{
+			Storage:              &store,
+			Quotas:               quotas,
+			QuotaKey:             func(r *http.Request) string { return "acme" },
+			TransactionalUploads: transactional,
+			Images:               &ImageOptions{Thumbnails: []ThumbnailSize{{Width: 4, Height: 4}}},
+		}
+
+		content := testPNG(t, 8, 8)
+		upload := func() []*UploadedFile {
+			t.Helper()
+			uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testPart{field: "file", fileName: "img.png", content: content}), "acme", false)
+			if err != nil {
+				t.Fatalf("transactional %t: %s", transactional, err)
+			}
+			return uploadedFiles
+		}
+
+		uploadedFiles := upload()
+		if len(uploadedFiles[0].Thumbnails) != 1 {
+			t.Fatalf("transactional %t: expected a thumbnail, but got %d", transactional, len(uploadedFiles[0].Thumbnails))
+		}
+		stored := uploadedFiles[0].FileSize + uploadedFiles[0].Thumbnails[0].FileSize
+
+		if usage, _ := quotas.Usage("acme"); usage.Bytes != stored || usage.Files != 2 {
+			t.Errorf("transactional %t: expected the thumbnail to be counted, but got %+v", transactional, usage)
+		}
+
+		// uploading the same name again replaces both files, which must not be counted twice
+		upload()
+
+		if usage, _ := quotas.Usage("acme"); usage.Bytes != stored || usage.Files != 2 {
+			t.Errorf("transactional %t: expected replaced files to be given back, but got %+v", transactional, usage)
+		}
+
+		if err := testTools.DeleteFile("acme", uploadedFiles[0].Key); err != nil {
+			t.Fatal(err)
+		}
+
+		if usage, _ := quotas.Usage("acme"); usage.Bytes != 0 || usage.Files != 0 {
+			t.Errorf("transactional %t: expected the thumbnail to be given back on delete, but got %+v", transactional, usage)
+		}
+		if saved, _ := store.List("acme/"); len(saved) != 0 {
+			t.Errorf("transactional %t: expected the thumbnail to be deleted, but found %d files", transactional, len(saved))
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package toolkit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3PartSize = 8 * 1024 * 1024
+	s3TimeFormat      = "20060102T150405Z"
+)
+
+// S3Storage is a Storage that keeps files in a bucket of an S3 compatible object store. Requests use path
+// style URLs (Endpoint/Bucket/key) and are signed with AWS Signature Version 4, so it works with AWS S3 as
+// well as MinIO, Ceph and similar servers
+type S3Storage struct {
+	// Endpoint is the base URL of the server, such as https://s3.us-east-1.amazonaws.com
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is only needed for temporary credentials
+	SessionToken string
+	// PartSize is the size of the parts used to upload big files. Files larger than PartSize are sent
+	// with a multipart upload. It defaults to 8MB; AWS S3 does not accept parts smaller than 5MB
+	PartSize int64
+	// Client is the http client used to call the server. When nil, http.DefaultClient is used
+	Client *http.Client
+
+	// now returns the time used to sign requests
+	now func() time.Time
+}
+
+// S3Error is returned when the server answers a request with an error status
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// Put uploads r under key. Contents up to PartSize are sent with a single request, bigger contents with a
+// multipart upload, which is aborted if any part fails
+func (s *S3Storage) Put(key string, r io.Reader) (ObjectInfo, error) {
+	buf := make([]byte, s.partSize())
+
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.putObject(key, buf[:n])
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return s.putMultipart(key, buf, r)
+}
+
+func (s *S3Storage) putObject(key string, data []byte) (ObjectInfo, error) {
+	header := make(http.Header)
+	if ctype := mime.TypeByExtension(path.Ext(key)); ctype != "" {
+		header.Set("Content-Type", ctype)
+	}
+
+	res, err := s.do(http.MethodPut, key, nil, header, data)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	res.Body.Close()
+
+	return ObjectInfo{Key: key, Size: int64(len(data)), ModTime: s.time(), ETag: trimETag(res.Header.Get("ETag"))}, nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *S3Storage) putMultipart(key string, buf []byte, r io.Reader) (ObjectInfo, error) {
+	header := make(http.Header)
+	if ctype := mime.TypeByExtension(path.Ext(key)); ctype != "" {
+		header.Set("Content-Type", ctype)
+	}
+
+	res, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&initiated)
+	res.Body.Close()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := s.uploadParts(key, initiated.UploadID, buf, r)
+	if err != nil {
+		// best effort, so the parts already sent do not linger in the bucket
+		if res, abortErr := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil); abortErr == nil {
+			res.Body.Close()
+		}
+		return ObjectInfo{}, err
+	}
+
+	return info, nil
+}
+
+func (s *S3Storage) uploadParts(key, uploadID string, buf []byte, r io.Reader) (ObjectInfo, error) {
+	var parts []s3CompletedPart
+	var size int64
+
+	n := len(buf)
+	for partNumber := 1; n > 0; partNumber++ {
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+
+		res, err := s.do(http.MethodPut, key, query, nil, buf[:n])
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+		res.Body.Close()
+
+		parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: res.Header.Get("ETag")})
+		size += int64(n)
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return ObjectInfo{}, err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	res, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer res.Body.Close()
+
+	// S3 may report a failure with a 200 status once the response has started, so the body is checked too
+	var completed struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		S3Error
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&completed); err != nil {
+		return ObjectInfo{}, err
+	}
+	if completed.XMLName.Local == "Error" {
+		completed.S3Error.StatusCode = res.StatusCode
+		return ObjectInfo{}, &completed.S3Error
+	}
+
+	return ObjectInfo{Key: key, Size: size, ModTime: s.time(), ETag: trimETag(completed.ETag)}, nil
+}
+
+// Get downloads the object saved under key. The returned body does not seek
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	res, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// GetRange returns a reader for length bytes of the object kept under key, starting at offset, with a
+// Range request. A negative length reads to the end of the object
+func (s *S3Storage) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	res, err := s.do(http.MethodGet, key, nil, http.Header{"Range": {byteRange}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Stat fetches the size, modification time and ETag of the object saved under key
+func (s *S3Storage) Stat(key string) (ObjectInfo, error) {
+	res, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	res.Body.Close()
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+
+	return ObjectInfo{Key: key, Size: res.ContentLength, ModTime: modTime, ETag: trimETag(res.Header.Get("ETag"))}, nil
+}
+
+// Delete removes the object saved under key. Like S3 itself, it does not fail when the key does not exist
+func (s *S3Storage) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// List returns every object whose key starts with prefix, following continuation tokens until the
+// listing is complete
+func (s *S3Storage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+
+	for {
+		res, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+				ETag         string    `xml:"ETag"`
+				Size         int64     `xml:"Size"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{Key: c.Key, Size: c.Size, ModTime: c.LastModified, ETag: trimETag(c.ETag)})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+
+	return objects, nil
+}
+
+// do sends a signed request for key, or for the bucket itself when key is empty. Responses with an error
+// status are turned into an *S3Error, or into an error matching fs.ErrNotExist for a 404
+func (s *S3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	uri := strings.TrimSuffix(s.Endpoint, "/") + "/" + s3URIEncode(s.Bucket, false)
+	if key != "" {
+		uri += "/" + s3URIEncode(key, false)
+	}
+	if len(query) > 0 {
+		uri += "?" + s3CanonicalQuery(query)
+	}
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, uri, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	payloadHash := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(payloadHash[:]), s.time())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound && key != "" {
+		return nil, &fs.PathError{Op: strings.ToLower(method), Path: key, Err: fs.ErrNotExist}
+	}
+
+	s3Err := &S3Error{StatusCode: res.StatusCode}
+	xml.NewDecoder(res.Body).Decode(s3Err)
+	return nil, s3Err
+}
+
+// sign adds the AWS Signature Version 4 headers to req. Every header already on req is signed, along
+// with the host
+func (s *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3TimeFormat)
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", amzDate[:8], s.Region)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), amzDate[:8])
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func (s *S3Storage) partSize() int64 {
+	if s.PartSize > 0 {
+		return s.PartSize
+	}
+	return defaultS3PartSize
+}
+
+func (s *S3Storage) time() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3URIEncode escapes s the way Signature Version 4 expects: every byte but the unreserved
+// characters is percent encoded, and slashes are kept unless encodeSlash is set
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// s3CanonicalQuery encodes query with its keys sorted, as both the request and its signature need
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+func trimETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
@@ -0,0 +1,188 @@
+package toolkit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const defaultMaxFileNameLength = 255
+
+// CollisionPolicy tells the upload functions what to do when a file that is not renamed has the same name
+// as a file already in the upload directory
+type CollisionPolicy int
+
+const (
+	// CollisionOverwrite replaces the existing file
+	CollisionOverwrite CollisionPolicy = iota
+	// CollisionError fails the upload with ErrFileExists
+	CollisionError
+	// CollisionSuffix saves the file with a numeric suffix, such as "report-1.pdf", "report-2.pdf"
+	CollisionSuffix
+)
+
+// ErrFileExists is returned when CollisionPolicy is CollisionError and an uploaded file has the same name
+// as an existing one
+var ErrFileExists = errors.New("a file with the same name already exists")
+
+// reservedFileNames are names Windows does not allow for files, whatever their extension
+var reservedFileNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// SanitizeFileName turns a file name sent by a client into one that is safe to save: directories are
+// stripped, Unicode is normalised to NFC, control and formatting characters are removed, characters not
+// allowed on common filesystems are replaced by underscores, leading dots are dropped, reserved names get
+// an underscore prefix, and the name is cut to MaxFileNameLength bytes, keeping its extension
+func (t *Tools) SanitizeFileName(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("empty file name not permitted")
+	}
+
+	// clients may send Windows paths, so both separators are stripped
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = norm.NFC.String(strings.ToValidUTF8(name, ""))
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	name = strings.TrimRight(name, ". ")
+
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	for _, reserved := range reservedFileNames {
+		if strings.TrimSpace(base) == reserved {
+			name = "_" + name
+			break
+		}
+	}
+
+	name = truncateFileName(name, t.maxFileNameLength())
+
+	if name == "" {
+		return "", errors.New("after removing characters, file name is zero length")
+	}
+	return name, nil
+}
+
+func (t *Tools) maxFileNameLength() int {
+	if t.MaxFileNameLength > 0 {
+		return t.MaxFileNameLength
+	}
+	return defaultMaxFileNameLength
+}
+
+// truncateFileName cuts name to at most max bytes without splitting a character, keeping the extension
+// unless it is too long itself
+func truncateFileName(name string, max int) string {
+	if max <= 0 {
+		return ""
+	}
+	if len(name) <= max {
+		return name
+	}
+
+	ext := path.Ext(name)
+	if len(ext) >= max {
+		ext = ""
+	}
+
+	base := strings.TrimSuffix(name, ext)
+	limit := max - len(ext)
+
+	for limit > 0 && !utf8.RuneStart(base[limit]) {
+		limit--
+	}
+
+	return base[:limit] + ext
+}
+
+// availableName returns the name a file that is not renamed is saved with in the upload directory,
+// applying t.CollisionPolicy when a file with that name already exists, or is pending in this request.
+// The entries of an archive never replace a file, since the archive is removed entry by entry when it
+// fails: CollisionOverwrite gives them a suffix instead
+func (u *upload) availableName(name string) (string, error) {
+	t := u.t
+
+	policy := t.CollisionPolicy
+	if policy == CollisionOverwrite && u.extracting {
+		policy = CollisionSuffix
+	}
+
+	if policy == CollisionOverwrite {
+		return name, nil
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 0; i < 10000; i++ {
+		candidate := name
+		if i > 0 {
+			suffix := fmt.Sprintf("-%d", i)
+			candidateExt := ext
+			budget := t.maxFileNameLength() - len(ext) - len(suffix)
+			if budget < 1 {
+				// an extension too long to leave room for the name is dropped, as truncateFileName does
+				candidateExt = ""
+				budget = t.maxFileNameLength() - len(suffix)
+			}
+			if budget < 1 {
+				budget = 1
+			}
+			candidate = truncateFileName(base, budget) + suffix + candidateExt
+		}
+
+		taken, err := u.nameTaken(candidate)
+		if err != nil {
+			return "", err
+		}
+
+		if !taken {
+			return candidate, nil
+		}
+
+		if policy == CollisionError {
+			return "", fmt.Errorf("%w: %q", ErrFileExists, name)
+		}
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrFileExists, name)
+}
+
+func (u *upload) nameTaken(name string) (bool, error) {
+	key := storageKey(u.uploadDir, name)
+
+	for _, p := range u.pending {
+		if p.file.Key == key {
+			return true, nil
+		}
+	}
+
+	_, err := u.t.storage().Stat(key)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,145 @@
+package toolkit
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var sanitizeTests = []struct {
+	name          string
+	fileName      string
+	expected      string
+	errorExpected bool
+}{
+	{name: "plain name", fileName: "report.pdf", expected: "report.pdf"},
+	{name: "unix traversal", fileName: "../../etc/passwd", expected: "passwd"},
+	{name: "windows traversal", fileName: `..\..\windows\system.ini`, expected: "system.ini"},
+	{name: "control characters", fileName: "bad\x00na\nme\x7f.txt", expected: "badname.txt"},
+	{name: "bidi override", fileName: "invoice\u202efdp.exe", expected: "invoicefdp.exe"},
+	{name: "forbidden characters", fileName: `what?<is>this*.txt`, expected: "what__is_this_.txt"},
+	{name: "hidden file", fileName: ".htaccess", expected: "htaccess"},
+	{name: "trailing dots and spaces", fileName: "name.txt. . ", expected: "name.txt"},
+	{name: "reserved name", fileName: "con.txt", expected: "_con.txt"},
+	{name: "reserved name without extension", fileName: "LPT1", expected: "_LPT1"},
+	{name: "unicode normalisation", fileName: "relato\u0301rio.pdf", expected: "relat\u00f3rio.pdf"},
+	{name: "too long", fileName: strings.Repeat("a", 300) + ".pdf", expected: strings.Repeat("a", 251) + ".pdf"},
+	{name: "too long multibyte", fileName: strings.Repeat("é", 200) + ".pdf", expected: strings.Repeat("é", 125) + ".pdf"},
+	{name: "empty", fileName: "", errorExpected: true},
+	{name: "only dots", fileName: "../..", errorExpected: true},
+}
+
+func TestTools_SanitizeFileName(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range sanitizeTests {
+		sanitized, err := testTools.SanitizeFileName(entry.fileName)
+
+		if entry.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", entry.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but one received: %s", entry.name, err)
+		}
+
+		if sanitized != entry.expected {
+			t.Errorf("%s: expected %q, but got %q", entry.name, entry.expected, sanitized)
+		}
+	}
+}
+
+func TestTools_UploadFilesCollisionPolicy(t *testing.T) {
+	var collisionTests = []struct {
+		name          string
+		policy        CollisionPolicy
+		expectedNames []string
+		errorExpected bool
+	}{
+		{name: "overwrite", policy: CollisionOverwrite, expectedNames: []string{"report.txt", "report.txt"}},
+		{name: "error", policy: CollisionError, errorExpected: true},
+		{name: "suffix", policy: CollisionSuffix, expectedNames: []string{"report-1.txt", "report-2.txt"}},
+	}
+
+	for _, entry := range collisionTests {
+		var store MemoryStorage
+		store.Put("uploads/report.txt", strings.NewReader("existing report"))
+
+		testTools := Tools{Storage: &store, CollisionPolicy: entry.policy, TransactionalUploads: true}
+
+		request := newUploadRequest(t,
+			testPart{field: "file", fileName: "../report.txt", content: []byte("first report")},
+			testPart{field: "file", fileName: "report.txt", content: []byte("second report")},
+		)
+
+		uploadedFiles, err := testTools.UploadFilesStream(request, "uploads", false)
+
+		if entry.errorExpected {
+			if !errors.Is(err, ErrFileExists) {
+				t.Errorf("%s: expected ErrFileExists, but got %v", entry.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %s", entry.name, err)
+		}
+
+		for i, f := range uploadedFiles {
+			if f.NewFileName != entry.expectedNames[i] {
+				t.Errorf("%s: expected file %d to be saved as %s, but got %s", entry.name, i, entry.expectedNames[i], f.NewFileName)
+			}
+		}
+	}
+}
+
+func TestTools_UploadFilesLongNameCollision(t *testing.T) {
+	var collisionTests = []struct {
+		name          string
+		maxLength     int
+		fileName      string
+		expectedNames []string
+	}{
+		{name: "extension filling the limit", fileName: "a." + strings.Repeat("x", 253), expectedNames: []string{"a." + strings.Repeat("x", 253), "a-1"}},
+		{name: "small limit", maxLength: 5, fileName: "a.jpeg", expectedNames: []string{"a.jpe", "a-1"}},
+		{name: "tiny limit", maxLength: 1, fileName: "ab.jpeg", expectedNames: []string{"a", "a-1"}},
+	}
+
+	for _, entry := range collisionTests {
+		testTools := Tools{Storage: &MemoryStorage{}, CollisionPolicy: CollisionSuffix, MaxFileNameLength: entry.maxLength}
+
+		for i, expected := range entry.expectedNames {
+			request := newUploadRequest(t, testPart{field: "file", fileName: entry.fileName, content: []byte("some text")})
+
+			uploadedFiles, err := testTools.UploadFiles(request, "uploads", false)
+			if err != nil {
+				t.Fatalf("%s: upload %d: %s", entry.name, i, err)
+			}
+
+			if uploadedFiles[0].NewFileName != expected {
+				t.Errorf("%s: expected upload %d to be saved as %s, but got %s", entry.name, i, expected, uploadedFiles[0].NewFileName)
+			}
+		}
+	}
+}
+
+func TestTools_UploadFilesRenamedUnsafeName(t *testing.T) {
+	testTools := Tools{Storage: &MemoryStorage{}}
+
+	request := newUploadRequest(t, testPart{field: "file", fileName: "...", content: []byte("some text")})
+	uploadedFiles, err := testTools.UploadFiles(request, "uploads", true)
+	if err != nil {
+		t.Fatalf("expected a renamed file to ignore its unusable name, but got %v", err)
+	}
+	if len(uploadedFiles[0].NewFileName) != 25 {
+		t.Errorf("expected a random name, but got %q", uploadedFiles[0].NewFileName)
+	}
+
+	request = newUploadRequest(t, testPart{field: "file", fileName: "...", content: []byte("some text")})
+	if _, err := testTools.UploadFiles(request, "uploads", false); err == nil {
+		t.Error("expected an error keeping an unusable name")
+	}
+}
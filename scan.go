@@ -0,0 +1,197 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClamdChunkSize = 64 * 1024
+	defaultClamdTimeout   = time.Minute
+)
+
+// ErrInfected is matched by the *InfectedError returned when Scanner finds a signature in an uploaded file
+var ErrInfected = errors.New("the uploaded file is infected")
+
+// InfectedError reports the uploaded file a Scanner found a signature in, and the name of the signature.
+// It matches ErrInfected, so callers can check it with errors.Is
+type InfectedError struct {
+	FileName  string
+	Signature string
+}
+
+func (e *InfectedError) Error() string {
+	return fmt.Sprintf("the uploaded file %q is infected with %s", e.FileName, e.Signature)
+}
+
+func (e *InfectedError) Is(target error) bool {
+	return target == ErrInfected
+}
+
+// Scanner checks uploaded files for malware
+type Scanner interface {
+	// Scan reads r to its end and returns the name of the signature it matched, or an empty string
+	// when it is clean
+	Scan(ctx context.Context, r io.Reader) (signature string, err error)
+}
+
+// scan runs t.Scanner on the file just written to key. An infected file is moved to QuarantineDir when it
+// is set, and deleted otherwise
+func (u *upload) scan(key string, uploadedFile *UploadedFile) error {
+	t := u.t
+
+	obj, err := t.storage().Get(key)
+	if err != nil {
+		return err
+	}
+	signature, err := t.Scanner.Scan(u.ctx, obj)
+	obj.Close()
+	if err != nil {
+		return fmt.Errorf("the uploaded file could not be scanned: %w", err)
+	}
+
+	if signature == "" {
+		return nil
+	}
+
+	if t.QuarantineDir != "" {
+		quarantineKey := storageKey(t.QuarantineDir, uploadedFile.SHA256+"-"+uploadedFile.NewFileName)
+		if err := moveObject(t.storage(), key, quarantineKey); err != nil {
+			return err
+		}
+	}
+
+	return &InfectedError{FileName: uploadedFile.OriginalFileName, Signature: signature}
+}
+
+// ClamdScanner is a Scanner that sends files to a clamd daemon with its INSTREAM command
+type ClamdScanner struct {
+	// Network is "tcp" or "unix". It defaults to "tcp"
+	Network string
+	// Address is the address clamd listens on, such as "localhost:3310" or "/var/run/clamav/clamd.ctl"
+	Address string
+	// ChunkSize is the size of the chunks files are streamed in. It defaults to 64KB
+	ChunkSize int
+	// Timeout limits how long a scan may take, when the context has no earlier deadline. It defaults to
+	// one minute
+	Timeout time.Duration
+}
+
+// Scan streams r to clamd and returns the signature it reports. Files over the StreamMaxLength of clamd
+// are reported as an error rather than as clean
+func (c *ClamdScanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+	network := c.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultClamdTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, c.Address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// closing the connection unblocks any read or write when ctx is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultClamdChunkSize
+	}
+
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				// clamd closes the connection when the stream goes over its limit, and says so
+				if reply, replyErr := readClamdReply(conn); replyErr == nil {
+					return parseClamdReply(reply)
+				}
+				return "", err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+
+	// a zero length chunk ends the stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+
+	return parseClamdReply(reply)
+}
+
+func readClamdReply(conn net.Conn) (string, error) {
+	reply, err := io.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil && len(reply) == 0 {
+		return "", err
+	}
+	if i := bytes.IndexByte(reply, 0); i >= 0 {
+		reply = reply[:i]
+	}
+	if len(reply) == 0 {
+		return "", errors.New("clamd closed the connection without replying")
+	}
+	return strings.TrimSpace(string(reply)), nil
+}
+
+// parseClamdReply turns a reply such as "stream: OK" or "stream: Eicar-Signature FOUND" into a signature
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", result)
+	}
+}
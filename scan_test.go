@@ -0,0 +1,134 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testEICAR = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// newFakeClamd starts a server speaking the INSTREAM command of clamd on network, reporting streams that
+// contain the EICAR test string as infected
+func newFakeClamd(t *testing.T, network, address string) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeClamd(conn)
+		}
+	}()
+
+	return l
+}
+
+func serveFakeClamd(conn net.Conn) {
+	defer conn.Close()
+
+	command := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+
+	var data bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&data, conn, int64(size)); err != nil {
+			return
+		}
+	}
+
+	if bytes.Contains(data.Bytes(), []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+		io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+		return
+	}
+	io.WriteString(conn, "stream: OK\x00")
+}
+
+func TestClamdScanner(t *testing.T) {
+	tcp := newFakeClamd(t, "tcp", "127.0.0.1:0")
+	unix := newFakeClamd(t, "unix", filepath.Join(t.TempDir(), "clamd.sock"))
+
+	scanners := map[string]*ClamdScanner{
+		"tcp":  {Address: tcp.Addr().String(), ChunkSize: 16},
+		"unix": {Network: "unix", Address: unix.Addr().String()},
+	}
+
+	for name, scanner := range scanners {
+		signature, err := scanner.Scan(context.Background(), strings.NewReader(strings.Repeat("clean content ", 100)))
+		if err != nil || signature != "" {
+			t.Errorf("%s: expected a clean result, but got %q, %v", name, signature, err)
+		}
+
+		signature, err = scanner.Scan(context.Background(), strings.NewReader(testEICAR))
+		if err != nil || signature != "Eicar-Signature" {
+			t.Errorf("%s: expected the signature to be reported, but got %q, %v", name, signature, err)
+		}
+	}
+
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("expected an error reply to be reported as an error")
+	}
+}
+
+func TestTools_UploadFilesScanner(t *testing.T) {
+	clamd := newFakeClamd(t, "tcp", "127.0.0.1:0")
+	scanner := &ClamdScanner{Address: clamd.Addr().String()}
+
+	for _, quarantine := range []string{"", "quarantine"} {
+		var store MemoryStorage
+		testTools := Tools{Storage: &store, Scanner: scanner, QuarantineDir: quarantine}
+
+		request := newUploadRequest(t,
+			testPart{field: "file", fileName: "clean.txt", content: []byte("nothing to see here")},
+			testPart{field: "file", fileName: "eicar.com", content: []byte(testEICAR)},
+		)
+
+		uploadedFiles, err := testTools.UploadFilesStream(request, "uploads", false)
+
+		var infected *InfectedError
+		if !errors.As(err, &infected) || !errors.Is(err, ErrInfected) || infected.FileName != "eicar.com" || infected.Signature != "Eicar-Signature" {
+			t.Fatalf("quarantine %q: expected an *InfectedError for eicar.com, but got %v", quarantine, err)
+		}
+
+		if len(uploadedFiles) != 1 || uploadedFiles[0].Key != "uploads/clean.txt" {
+			t.Errorf("quarantine %q: expected the clean file to be saved, but got %+v", quarantine, uploadedFiles)
+		}
+
+		saved, _ := store.List("uploads/")
+		if len(saved) != 1 {
+			t.Errorf("quarantine %q: expected only the clean file in the upload directory, but found %+v", quarantine, saved)
+		}
+
+		quarantined, _ := store.List("quarantine/")
+		if quarantine == "" && len(quarantined) != 0 {
+			t.Errorf("expected the infected file to be deleted, but found %+v", quarantined)
+		}
+		if quarantine != "" && (len(quarantined) != 1 || !strings.HasSuffix(quarantined[0].Key, "-eicar.com")) {
+			t.Errorf("expected the infected file to be quarantined, but found %+v", quarantined)
+		}
+	}
+}
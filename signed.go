@@ -0,0 +1,166 @@
+package toolkit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned when a signed URL was tampered with, was signed with an unknown key,
+	// or is used from another IP address or with another method than it was signed for
+	ErrInvalidSignature = errors.New("the link is invalid")
+	// ErrLinkExpired is returned when a signed URL is used after its expiry
+	ErrLinkExpired = errors.New("the link has expired")
+)
+
+// SignOptions restricts what a signed URL may be used for. Zero values mean no restriction
+type SignOptions struct {
+	// IP is the only client IP address the URL works for
+	IP string
+	// Method is the only HTTP method the URL works with, such as GET. A URL for GET works with HEAD too
+	Method string
+	// DisplayName is the name the file is downloaded as. It defaults to the base name of the file
+	DisplayName string
+}
+
+// URLSigner signs URLs to files with HMAC-SHA256, so they can be handed out to clients that are not
+// otherwise authenticated, and verifies them
+type URLSigner struct {
+	// BaseURL is where SignedDownloadHandler is served, such as https://example.com/files
+	BaseURL string
+	// Keys are the secret keys, by id. New URLs are signed with the key named by CurrentKey, and URLs are
+	// verified with the key they name, so a key can be rotated by adding a new one, making it current,
+	// and removing the old one once the URLs it signed have expired
+	Keys       map[string][]byte
+	CurrentKey string
+	// ClientIP returns the IP address of the client of r, which URLs bound to an IP are checked against.
+	// It defaults to the host of r.RemoteAddr; set it when behind a proxy
+	ClientIP func(r *http.Request) string
+}
+
+// Sign returns a URL under BaseURL for the file named fileName, which works until expires. The query of
+// BaseURL, if any, is kept
+func (s *URLSigner) Sign(fileName string, expires time.Time, opts SignOptions) (string, error) {
+	key, ok := s.Keys[s.CurrentKey]
+	if !ok || len(key) == 0 {
+		return "", fmt.Errorf("there is no signing key named %q", s.CurrentKey)
+	}
+
+	u, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return "", fmt.Errorf("parsing the base URL: %w", err)
+	}
+
+	query := u.Query()
+	query.Set("file", fileName)
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("kid", s.CurrentKey)
+	if opts.IP != "" {
+		query.Set("ip", opts.IP)
+	}
+	if opts.Method != "" {
+		query.Set("method", strings.ToUpper(opts.Method))
+	}
+	if opts.DisplayName != "" {
+		query.Set("name", opts.DisplayName)
+	}
+	query.Set("sig", signature(key, query))
+
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Verify checks the signed URL r was made with, returning the file name and the display name it gives
+// access to. It fails with ErrInvalidSignature or ErrLinkExpired
+func (s *URLSigner) Verify(r *http.Request) (fileName, displayName string, err error) {
+	query := r.URL.Query()
+
+	key, ok := s.Keys[query.Get("kid")]
+	if !ok || len(key) == 0 {
+		return "", "", ErrInvalidSignature
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get("sig"))
+	if err != nil {
+		return "", "", ErrInvalidSignature
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(signature(key, query))
+	if !hmac.Equal(sig, expected) {
+		return "", "", ErrInvalidSignature
+	}
+
+	// only once the signature is known to be good do the values of the URL mean anything
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return "", "", ErrInvalidSignature
+	}
+	if time.Now().Unix() > expires {
+		return "", "", ErrLinkExpired
+	}
+
+	// HEAD only asks for the headers of a GET, so a link for one works for the other
+	if method := query.Get("method"); method != "" && method != r.Method && !(method == http.MethodGet && r.Method == http.MethodHead) {
+		return "", "", ErrInvalidSignature
+	}
+	if ip := query.Get("ip"); ip != "" && ip != s.clientIP(r) {
+		return "", "", ErrInvalidSignature
+	}
+
+	fileName = query.Get("file")
+	displayName = query.Get("name")
+	if displayName == "" {
+		displayName = path.Base(fileName)
+	}
+	return fileName, displayName, nil
+}
+
+func (s *URLSigner) clientIP(r *http.Request) string {
+	if s.ClientIP != nil {
+		return s.ClientIP(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// signature returns the HMAC of the signed values of query. Each value is prefixed by its length, so
+// moving characters from one value to another changes the signature
+func signature(key []byte, query url.Values) string {
+	mac := hmac.New(sha256.New, key)
+	for _, name := range []string{"file", "expires", "kid", "ip", "method", "name"} {
+		value := query.Get(name)
+		fmt.Fprintf(mac, "%s:%d:%s\n", name, len(value), value)
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignedDownloadHandler returns a handler that serves the files in pathName, or under the pathName prefix
+// of Storage, to the URLs signed by signer, the way DownloadStaticFile does. Invalid URLs get a 403 and
+// expired ones a 410, with an ErrorJSON response
+func (t *Tools) SignedDownloadHandler(signer *URLSigner, pathName string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileName, displayName, err := signer.Verify(r)
+		if errors.Is(err, ErrLinkExpired) {
+			t.ErrorJSON(w, err, http.StatusGone)
+			return
+		}
+		if err != nil {
+			t.ErrorJSON(w, err, http.StatusForbidden)
+			return
+		}
+
+		t.DownloadStaticFile(w, r, pathName, fileName, displayName)
+	})
+}
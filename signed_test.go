@@ -0,0 +1,104 @@
+package toolkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTools_SignedDownloadHandler(t *testing.T) {
+	var testTools Tools
+
+	signer := &URLSigner{
+		BaseURL:    "http://example.com/files",
+		Keys:       map[string][]byte{"old": []byte("old secret"), "new": []byte("new secret")},
+		CurrentKey: "old",
+	}
+	handler := testTools.SignedDownloadHandler(signer, "./testdata")
+
+	sign := func(fileName string, expires time.Time, opts SignOptions) string {
+		link, err := signer.Sign(fileName, expires, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link
+	}
+
+	oldLink := sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{})
+	signer.CurrentKey = "new"
+
+	var signedTests = []struct {
+		name           string
+		link           string
+		method         string
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{name: "valid", link: sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{DisplayName: "puppy.jpg"}), expectedStatus: http.StatusOK},
+		{name: "rotated key", link: oldLink, expectedStatus: http.StatusOK},
+		{name: "expired", link: sign("pic.jpg", time.Now().Add(-time.Minute), SignOptions{}), expectedStatus: http.StatusGone},
+		{name: "tampered file", link: strings.Replace(sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{}), "pic.jpg", "img.png", 1), expectedStatus: http.StatusForbidden},
+		{name: "tampered expiry", link: strings.Replace(sign("pic.jpg", time.Unix(1000, 0), SignOptions{}), "expires=1000", "expires=99999999999", 1), expectedStatus: http.StatusForbidden},
+		{name: "unknown key", link: strings.Replace(sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{}), "kid=new", "kid=other", 1), expectedStatus: http.StatusForbidden},
+		{name: "no signature", link: "http://example.com/files?file=pic.jpg&expires=99999999999&kid=new", expectedStatus: http.StatusForbidden},
+		{name: "bound ip", link: sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{IP: "192.0.2.1"}), remoteAddr: "192.0.2.1:1234", expectedStatus: http.StatusOK},
+		{name: "other ip", link: sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{IP: "192.0.2.1"}), remoteAddr: "192.0.2.2:1234", expectedStatus: http.StatusForbidden},
+		{name: "other method", link: sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{Method: "get"}), method: "DELETE", expectedStatus: http.StatusForbidden},
+		{name: "head on a get link", link: sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{Method: "get"}), method: "HEAD", expectedStatus: http.StatusOK},
+		{name: "get on a head link", link: sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{Method: "head"}), method: "GET", expectedStatus: http.StatusForbidden},
+		{name: "outside the directory", link: sign("../tools.go", time.Now().Add(time.Hour), SignOptions{}), expectedStatus: http.StatusNotFound},
+	}
+
+	for _, entry := range signedTests {
+		method := entry.method
+		if method == "" {
+			method = "GET"
+		}
+
+		req := httptest.NewRequest(method, entry.link, nil)
+		if entry.remoteAddr != "" {
+			req.RemoteAddr = entry.remoteAddr
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != entry.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d: %s", entry.name, entry.expectedStatus, rr.Code, rr.Body.String())
+		}
+		if entry.expectedStatus >= 400 && entry.expectedStatus != http.StatusNotFound && !strings.Contains(rr.Body.String(), `"error":true`) {
+			t.Errorf("%s: expected a JSON error, but got %q", entry.name, rr.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest("GET", sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{DisplayName: "puppy.jpg"}), nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Header().Get("Content-Disposition") != `attachment; filename="puppy.jpg"` {
+		t.Errorf("wrong Content-Disposition: %s", rr.Header().Get("Content-Disposition"))
+	}
+
+	// the query of the base URL is kept
+	signer.BaseURL = "http://example.com/download?bucket=photos"
+	link := sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{})
+	if !strings.HasPrefix(link, "http://example.com/download?") || !strings.Contains(link, "bucket=photos") || strings.Count(link, "?") != 1 {
+		t.Errorf("expected the base URL query to be merged, but got %s", link)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", link, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected a link with a base URL query to work, but got %d", rr.Code)
+	}
+
+	signer.BaseURL = "http://example.com/%zz"
+	if _, err := signer.Sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{}); err == nil {
+		t.Error("expected an error signing with an invalid base URL")
+	}
+
+	signer.CurrentKey = "missing"
+	if _, err := signer.Sign("pic.jpg", time.Now().Add(time.Hour), SignOptions{}); err == nil {
+		t.Error("expected an error signing with a missing key")
+	}
+}
@@ -0,0 +1,318 @@
+package toolkit
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectInfo describes a file kept by a Storage
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	ETag    string
+}
+
+// Storage is the interface used by Tools to save and read files. Keys are slash separated paths, such as
+// "uploads/picture.png". Implementations report missing keys with an error that matches fs.ErrNotExist
+type Storage interface {
+	// Put saves everything read from r under key, replacing any existing file
+	Put(key string, r io.Reader) (ObjectInfo, error)
+	// Get opens the file saved under key. The caller must close it
+	Get(key string) (io.ReadCloser, error)
+	// Stat returns information about the file saved under key
+	Stat(key string) (ObjectInfo, error)
+	// Delete removes the file saved under key
+	Delete(key string) error
+	// List returns every file whose key starts with prefix, sorted by key
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// Renamer is implemented by storages that can move a file to a new key without copying its contents
+type Renamer interface {
+	Rename(oldKey, newKey string) error
+}
+
+// moveObject moves the file saved under oldKey to newKey, replacing any file already there. Storages that
+// do not implement Renamer get a copy followed by a delete
+func moveObject(s Storage, oldKey, newKey string) error {
+	if renamer, ok := s.(Renamer); ok {
+		return renamer.Rename(oldKey, newKey)
+	}
+
+	obj, err := s.Get(oldKey)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	if _, err := s.Put(newKey, obj); err != nil {
+		return err
+	}
+
+	return s.Delete(oldKey)
+}
+
+// storage returns the Storage used by t, which defaults to the local filesystem
+func (t *Tools) storage() Storage {
+	if t.Storage != nil {
+		return t.Storage
+	}
+	return LocalStorage{}
+}
+
+// storageKey builds the key of fileName inside dir, which may be a filesystem path
+func storageKey(dir, fileName string) string {
+	return path.Join(filepath.ToSlash(dir), fileName)
+}
+
+// LocalStorage is a Storage that keeps files on the local filesystem. Keys are resolved relative to Root,
+// or to the working directory when Root is empty
+type LocalStorage struct {
+	Root string
+}
+
+func (s LocalStorage) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(key))
+}
+
+// Put saves r to the file named by key, creating any missing parent directories
+func (s LocalStorage) Put(key string, r io.Reader) (ObjectInfo, error) {
+	p := s.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	if err := f.Close(); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return s.Stat(key)
+}
+
+// Get opens the file named by key. The returned value is an *os.File
+func (s LocalStorage) Get(key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+// Stat returns the size and modification time of the file named by key
+func (s LocalStorage) Stat(key string) (ObjectInfo, error) {
+	fi, err := os.Stat(s.path(key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	if fi.IsDir() {
+		return ObjectInfo{}, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+	}
+
+	return ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Rename moves the file named by oldKey to newKey with os.Rename, which is atomic when both keys are in
+// the same filesystem
+func (s LocalStorage) Rename(oldKey, newKey string) error {
+	p := s.path(newKey)
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(s.path(oldKey), p)
+}
+
+// Delete removes the file named by key
+func (s LocalStorage) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+// List walks the directory holding prefix and returns every regular file whose key starts with prefix
+func (s LocalStorage) List(prefix string) ([]ObjectInfo, error) {
+	clean := path.Clean(prefix)
+	if clean == "." {
+		clean = ""
+	} else if strings.HasSuffix(prefix, "/") {
+		clean += "/"
+	}
+
+	dir := clean
+	if !strings.HasSuffix(clean, "/") {
+		dir = path.Dir(clean)
+	}
+
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(s.path(dir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.path(dir), p)
+		if err != nil {
+			return err
+		}
+
+		key := path.Join(dir, filepath.ToSlash(rel))
+		if !strings.HasPrefix(key, clean) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+
+	return objects, err
+}
+
+// MemoryStorage is a Storage that keeps files in memory, which is mostly useful for tests. The zero value
+// is ready to use, and it is safe for concurrent use
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+	etag    string
+}
+
+// memoryFile is returned by MemoryStorage.Get. It can seek, so it can be served with http.ServeContent
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
+
+func (o memoryObject) info(key string) ObjectInfo {
+	return ObjectInfo{Key: key, Size: int64(len(o.data)), ModTime: o.modTime, ETag: o.etag}
+}
+
+// Put reads r fully and keeps its contents under key. The ETag is the hex encoded MD5 of the contents
+func (s *MemoryStorage) Put(key string, r io.Reader) (ObjectInfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	sum := md5.Sum(data)
+	obj := memoryObject{data: data, modTime: time.Now(), etag: hex.EncodeToString(sum[:])}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.objects == nil {
+		s.objects = make(map[string]memoryObject)
+	}
+	s.objects[key] = obj
+
+	return obj.info(key), nil
+}
+
+// Get returns a reader over the contents kept under key
+func (s *MemoryStorage) Get(key string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: key, Err: fs.ErrNotExist}
+	}
+
+	return memoryFile{bytes.NewReader(obj.data)}, nil
+}
+
+// Stat returns information about the contents kept under key
+func (s *MemoryStorage) Stat(key string) (ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return ObjectInfo{}, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+	}
+
+	return obj.info(key), nil
+}
+
+// Rename moves the contents kept under oldKey to newKey
+func (s *MemoryStorage) Rename(oldKey, newKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[oldKey]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldKey, Err: fs.ErrNotExist}
+	}
+	delete(s.objects, oldKey)
+	s.objects[newKey] = obj
+
+	return nil
+}
+
+// Delete removes the contents kept under key
+func (s *MemoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[key]; !ok {
+		return &fs.PathError{Op: "delete", Path: key, Err: fs.ErrNotExist}
+	}
+	delete(s.objects, key)
+
+	return nil
+}
+
+// List returns every key starting with prefix, sorted
+func (s *MemoryStorage) List(prefix string) ([]ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var objects []ObjectInfo
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, obj.info(key))
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return objects, nil
+}
@@ -0,0 +1,154 @@
+package toolkit
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testStorage(t *testing.T, s Storage) {
+	t.Helper()
+
+	for _, key := range []string{"uploads/a.txt", "uploads/nested/b.txt", "other/c.txt"} {
+		info, err := s.Put(key, strings.NewReader("hello "+key))
+		if err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+		if info.Size != int64(len("hello "+key)) {
+			t.Errorf("put %s: wrong size %d", key, info.Size)
+		}
+	}
+
+	obj, err := s.Get("uploads/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(data) != "hello uploads/a.txt" {
+		t.Errorf("wrong contents read: %q", data)
+	}
+
+	info, err := s.Stat("uploads/nested/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "uploads/nested/b.txt" || info.Size != 26 || info.ModTime.IsZero() {
+		t.Errorf("wrong stat result: %+v", info)
+	}
+
+	objects, err := s.List("uploads/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "uploads/a.txt" || objects[1].Key != "uploads/nested/b.txt" {
+		t.Errorf("wrong list result: %+v", objects)
+	}
+
+	if err := s.Delete("uploads/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Stat("uploads/a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error after delete, but got %v", err)
+	}
+
+	if _, err := s.Get("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error for missing key, but got %v", err)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	testStorage(t, LocalStorage{Root: t.TempDir()})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, &MemoryStorage{})
+}
+
+func TestLocalStorage_RelativeKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	s := LocalStorage{}
+	key := storageKey(dir, "file.txt")
+
+	if _, err := s.Put(key, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "file.txt")); err != nil {
+		t.Errorf("expected file to be written to %s: %s", dir, err)
+	}
+
+	objects, err := s.List(storageKey(dir, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != key {
+		t.Errorf("wrong list result: %+v", objects)
+	}
+}
+
+func TestTools_UploadFilesToStorage(t *testing.T) {
+	var store MemoryStorage
+	testTools := Tools{Storage: &store, AllowedFileTypes: []string{"image/png"}}
+
+	request := newUploadRequest(t, testPart{field: "file", fileName: "img.png", content: testPNG(t, 8, 8)})
+
+	uploadedFiles, err := testTools.UploadFiles(request, "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := store.Stat("uploads/" + uploadedFiles[0].NewFileName)
+	if err != nil {
+		t.Fatal("expected file to be kept in storage:", err)
+	}
+
+	if info.Size != uploadedFiles[0].FileSize {
+		t.Errorf("wrong file size; expected %d, but got %d", info.Size, uploadedFiles[0].FileSize)
+	}
+
+	if _, err := os.Stat("uploads"); !os.IsNotExist(err) {
+		t.Error("upload directory should not be created on disk when using a storage")
+	}
+}
+
+func TestTools_DownloadStaticFileFromStorage(t *testing.T) {
+	var store MemoryStorage
+	testTools := Tools{Storage: &store}
+
+	if _, err := store.Put("files/report.txt", strings.NewReader("some report")); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	testTools.DownloadStaticFile(rr, req, "files", "report.txt", "report.txt")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code; expected 200, but got %d", rr.Code)
+	}
+
+	if rr.Body.String() != "some report" {
+		t.Errorf("wrong body: %q", rr.Body.String())
+	}
+
+	if disposition := rr.Header().Get("Content-Disposition"); disposition != `attachment; filename="report.txt"` {
+		t.Error("wrong content disposition:", disposition)
+	}
+
+	rr = httptest.NewRecorder()
+	testTools.DownloadStaticFile(rr, req, "files", "missing.txt", "missing.txt")
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code for missing file; expected 404, but got %d", rr.Code)
+	}
+}
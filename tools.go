@@ -2,7 +2,11 @@ package toolkit
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,10 +14,13 @@ import (
 	"math"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -21,13 +28,101 @@ const (
 	randomStringSource = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVXYZ0123456789_+"
 )
 
+var (
+	// ErrFileTooLarge is matched by the *FileTooLargeError returned when a file is bigger than MaxFileSize
+	ErrFileTooLarge = errors.New("the uploaded file is too big")
+	// ErrRequestTooLarge is returned when the files of a single request add up to more than MaxUploadSize
+	ErrRequestTooLarge = errors.New("the uploaded files are too big")
+	// ErrMalformedMultipart is returned when the request body is not a valid multipart form
+	ErrMalformedMultipart = errors.New("the request is not a valid multipart form")
+)
+
+// FileTooLargeError reports the file that went over MaxFileSize, and the limit itself.
+// It matches ErrFileTooLarge, so callers can check it with errors.Is
+type FileTooLargeError struct {
+	FileName string
+	Limit    int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("the uploaded file %q is bigger than %d bytes", e.FileName, e.Limit)
+}
+
+func (e *FileTooLargeError) Is(target error) bool {
+	return target == ErrFileTooLarge
+}
+
 // Tools is the type used to instantiate this module. Any variable of this type will have access
 // to all the methods with the reciever *Tools
 type Tools struct {
-	MaxFileSize        int
-	AllowedFileTypes   []string
+	// MaxFileSize is the largest size, in bytes, of each uploaded file. It defaults to 1GB
+	MaxFileSize int
+	// MaxUploadSize is the largest size, in bytes, of all the files uploaded in a single request.
+	// Zero means no limit
+	MaxUploadSize int
+	// AllowedFileTypes are the MIME types accepted for uploaded files, which are detected with FileTypes.
+	// When empty, every type is accepted
+	AllowedFileTypes []string
+	// FileTypes is the registry used to detect the type of uploaded files. When nil, DefaultFileTypes is used
+	FileTypes *FileTypeRegistry
+	// Quotas, when set along with QuotaKey, limits the bytes and files each tenant may store. QuotaKey
+	// returns the tenant the files of a request are counted against; an empty tenant has no quota.
+	// Uploads that would go over the quota fail with ErrQuotaExceeded, and DeleteFile gives space back
+	Quotas   QuotaStore
+	QuotaKey func(r *http.Request) string
+	// FieldRules are the rules for the files of each form field, such as the types, size and number of
+	// files accepted. Fields without a rule are checked against AllowedFileTypes and MaxFileSize only.
+	// Files rejected by a rule are reported with a *FieldError naming their field. UploadFilesStream only
+	// finds out a field has too few files at the end of the request, so use TransactionalUploads with it
+	// to keep nothing in that case
+	FieldRules map[string]FieldRule
+	// ExtensionPolicy chooses what happens when the extension or Content-Type of an uploaded file
+	// disagrees with its detected type. The default, ExtensionKeep, does not check them
+	ExtensionPolicy ExtensionPolicy
+	// CollisionPolicy chooses what happens when a file uploaded without renaming has the same name as an
+	// existing file. The default, CollisionOverwrite, replaces it
+	CollisionPolicy CollisionPolicy
+	// MaxFileNameLength is the longest name, in bytes, uploaded files are saved with. It defaults to 255
+	MaxFileNameLength int
+	// ComputeMD5 adds the MD5 digest of uploaded files to their SHA-256, for clients that still use it
+	ComputeMD5 bool
+	// ContentAddressed saves uploaded files named after their SHA-256 digest, so identical files are only
+	// stored once. Files are renamed this way whatever the rename argument of the upload functions
+	ContentAddressed bool
+	// Images enables the processing of uploaded images: dimension limits, metadata stripping and thumbnails.
+	// When nil, images are saved as they are received
+	Images *ImageOptions
+	// Scanner, when set, checks each uploaded file for malware before it is made visible in the upload
+	// directory. Infected files fail the upload with an *InfectedError
+	Scanner Scanner
+	// QuarantineDir is where infected files are moved to, named after their digest and name. When empty,
+	// infected files are deleted
+	QuarantineDir string
+	// Archives enables the extraction of uploaded zip, tar and tar.gz archives into the upload directory.
+	// When nil, archives are saved as they are received
+	Archives *ArchiveOptions
+	// DigestField is the name of a form field holding the expected SHA-256 digest, hex encoded, of each
+	// uploaded file, in the order the files appear in the request. Files whose digest does not match are
+	// removed and ErrDigestMismatch is returned. Empty values are not checked
+	DigestField string
+	// TransactionalUploads makes uploads all or nothing: every file of a request is first written to a
+	// temporary file in the upload directory, and only moved into place once all of them were accepted.
+	// When any file fails, everything written for the request is removed, the files it replaced are
+	// restored, and no files are returned
+	TransactionalUploads bool
+	// MaxFormValuesSize is the largest size, in bytes, of the values of all the fields that are not files,
+	// kept by UploadForm. It defaults to 10MB
+	MaxFormValuesSize  int
 	MaxJSONSize        int
 	AllowUnknownFields bool
+	// Disposition tells browsers whether downloaded files are saved, the default, or shown inline
+	Disposition Disposition
+	// Compression enables the compression of downloads, and of every response of the handlers wrapped with
+	// CompressHandler. When nil, nothing is compressed
+	Compression *CompressionOptions
+	// Storage is where uploaded files are saved and downloaded files are read from.
+	// When nil, the local filesystem is used
+	Storage Storage
 }
 
 /**
@@ -57,121 +152,699 @@ type UploadedFile struct {
 	NewFileName      string
 	OriginalFileName string
 	FileSize         int64
+	// FieldName is the name of the form field the file was sent in, ContentType the type the client
+	// declared for it, and Header all the headers of its part
+	FieldName   string
+	ContentType string
+	Header      textproto.MIMEHeader
+	// Key is where the file was saved in the Storage, and ETag is the entity tag the Storage
+	// reported for it, if any
+	Key  string
+	ETag string
+	// DetectedType and DetectedExtension are the MIME type and usual extension of the file,
+	// detected from its contents
+	DetectedType      string
+	DetectedExtension string
+	// SHA256 is the hex encoded SHA-256 digest of the file, as it was received. MD5 is only set when
+	// Tools.ComputeMD5 is
+	SHA256 string
+	MD5    string
+	// Width and Height are the dimensions of images processed with Tools.Images, and Thumbnails the
+	// thumbnails generated for them
+	Width      int
+	Height     int
+	Thumbnails []*UploadedFile
+	// Extracted are the files extracted from an archive with Tools.Archives
+	Extracted []*UploadedFile
 }
 
 type UploadFilesParams struct {
 	uploadedFiles []*UploadedFile
-	header        *multipart.FileHeader
-	t             *Tools
-	renameFile    bool
-	uploadDir     string
+	file          *formFile
+	upload        *upload
 }
 
 func uploadFiles(ufp UploadFilesParams) ([]*UploadedFile, error) {
-	uploadedFiles, header, t, renameFile, uploadDir := ufp.uploadedFiles, ufp.header, ufp.t, ufp.renameFile, ufp.uploadDir
+	uploadedFiles, file, u := ufp.uploadedFiles, ufp.file, ufp.upload
 
-	var uploadedFile UploadedFile
-	inFile, err := header.Open()
+	inFile, err := file.open()
 	if err != nil {
-		return nil, err
+		return uploadedFiles, err
 	}
 	defer inFile.Close()
 
-	buff := make([]byte, 512)
-	_, err = inFile.Read(buff)
+	uploadedFile, err := u.saveFile(inFile, file.field, file.fileName, file.header)
 	if err != nil {
+		return uploadedFiles, err
+	}
+	u.setPosition(uploadedFile, file.position)
+
+	uploadedFiles = append(uploadedFiles, uploadedFile)
+	return uploadedFiles, nil
+}
+
+// upload holds the state shared by all the files of a single upload request
+type upload struct {
+	t          *Tools
+	ctx        context.Context
+	uploadDir  string
+	renameFile bool
+	// progress, when not nil, is called as the files are written; total is the length of the request body
+	progress ProgressFunc
+	total    int64
+	// written is the number of bytes read from the files of the request so far
+	written int64
+	// pending are the files written to temporary keys in transactional mode, waiting to be committed
+	pending []pendingFile
+	// expectedDigests are the values of the DigestField form field, and positions the index of each saved
+	// file among the file parts of the request, which its expected digest is found by
+	expectedDigests []string
+	positions       map[*UploadedFile]int
+	// deduplicated are the content addressed files that were already stored before this request
+	deduplicated map[*UploadedFile]bool
+	// fieldCounts is the number of files seen in each form field
+	fieldCounts map[string]int
+	// onlyField, when set, is the only form field files are saved from, and maxFiles, when not zero, is
+	// the most files saved from the request
+	onlyField string
+	maxFiles  int
+	fileCount int
+	// extracting is set while the entries of an archive are saved, so archives inside it are left alone
+	extracting bool
+	// tenant is the tenant whose quota the files are counted against, and reserved the files counted so far
+	tenant   string
+	reserved map[*UploadedFile]bool
+}
+
+type pendingFile struct {
+	tempKey string
+	file    *UploadedFile
+	moved   bool
+	// displaced is where the file the pending one replaces was moved aside, so a rollback can restore it,
+	// and replaced what it gives back to the quota once the commit succeeds
+	displaced string
+	replaced  *replacedFile
+}
+
+// finish ends the upload. In transactional mode, the pending files are moved into place when err is
+// nil, and everything written is removed otherwise. Everything is removed as well when the upload was
+// aborted through its context
+func (u *upload) finish(uploadedFiles []*UploadedFile, err error) ([]*UploadedFile, error) {
+	if err == nil {
+		uploadedFiles, err = u.verifyDigests(uploadedFiles)
+	}
+
+	if !u.t.TransactionalUploads {
+		if err != nil && u.ctx.Err() != nil {
+			// an aborted request leaves nothing behind, not even the files it completed
+			for _, uploadedFile := range uploadedFiles {
+				u.remove(uploadedFile)
+			}
+			return nil, err
+		}
+		return uploadedFiles, err
+	}
+
+	if err == nil {
+		err = u.commit()
+	}
+
+	if err != nil {
+		u.rollback()
 		return nil, err
 	}
 
-	//check to see if the file type is permitted
-	allowed := false
-	fileType := http.DetectContentType(buff)
+	return uploadedFiles, nil
+}
+
+func (u *upload) commit() error {
+	for i := range u.pending {
+		p := &u.pending[i]
+
+		if u.t.ContentAddressed {
+			if _, err := u.t.storage().Stat(p.file.Key); err == nil {
+				// an identical file is already stored, which must survive a rollback
+				u.t.storage().Delete(p.tempKey)
+				continue
+			}
+		}
 
-	if len(t.AllowedFileTypes) > 0 {
-		for _, typeReceived := range t.AllowedFileTypes {
-			if strings.EqualFold(fileType, typeReceived) {
-				allowed = true
+		if info, err := u.t.storage().Stat(p.file.Key); err == nil {
+			// the file being replaced is kept aside until every move succeeded
+			displaced := storageKey(path.Dir(p.file.Key), fmt.Sprintf(".%s.displaced", u.t.RandomString(20)))
+			if err := moveObject(u.t.storage(), p.file.Key, displaced); err != nil {
+				return err
 			}
+			p.displaced = displaced
+			p.replaced = u.replacedPending(i, info.Size)
+		}
+
+		if err := moveObject(u.t.storage(), p.tempKey, p.file.Key); err != nil {
+			return err
+		}
+		p.moved = true
+	}
+
+	for _, p := range u.pending {
+		if p.displaced != "" {
+			u.t.storage().Delete(p.displaced)
+			u.releaseReplaced(p.replaced)
+		}
+	}
+	return nil
+}
+
+// rollback undoes the commit in reverse order, so when files of the request replaced each other, the file
+// that was there first is the one restored
+func (u *upload) rollback() {
+	for i := len(u.pending) - 1; i >= 0; i-- {
+		p := u.pending[i]
+		u.releaseQuota(p.file)
+		if p.moved {
+			u.t.storage().Delete(p.file.Key)
+		} else {
+			u.t.storage().Delete(p.tempKey)
 		}
+		if p.displaced != "" {
+			moveObject(u.t.storage(), p.displaced, p.file.Key)
+		}
+	}
+}
+
+// saveDerived saves a file generated from an uploaded one, such as a thumbnail, in the upload directory
+// under uploadedFile.NewFileName, and counts it against the quota. In transactional mode it is committed or
+// rolled back with the others
+func (u *upload) saveDerived(uploadedFile *UploadedFile, r io.Reader) error {
+	uploadedFile.Key = storageKey(u.uploadDir, uploadedFile.NewFileName)
+
+	key := uploadedFile.Key
+	var replaced *replacedFile
+	if u.t.TransactionalUploads {
+		key = storageKey(u.uploadDir, fmt.Sprintf(".%s.upload", u.t.RandomString(20)))
 	} else {
-		allowed = true
+		replaced = u.replacing(key)
+	}
+
+	info, err := u.t.storage().Put(key, r)
+	if err != nil {
+		u.t.storage().Delete(key)
+		return err
+	}
+	uploadedFile.FileSize = info.Size
+	uploadedFile.ETag = info.ETag
+	u.releaseReplaced(replaced)
+
+	if u.t.TransactionalUploads {
+		u.pending = append(u.pending, pendingFile{tempKey: key, file: uploadedFile})
+	}
+
+	if err := u.reserveQuota(uploadedFile); err != nil {
+		// in transactional mode, the file is pending and goes away with the rollback
+		if !u.t.TransactionalUploads {
+			u.t.storage().Delete(key)
+		}
+		return err
 	}
+	return nil
+}
+
+// remove deletes an uploaded file saved outside of a transaction, along with its thumbnails and the files
+// extracted from it
+func (u *upload) remove(uploadedFile *UploadedFile) {
+	for _, thumbnail := range uploadedFile.Thumbnails {
+		u.t.storage().Delete(thumbnail.Key)
+		u.releaseQuota(thumbnail)
+	}
+
+	for _, extracted := range uploadedFile.Extracted {
+		u.remove(extracted)
+	}
+
+	if !u.deduplicated[uploadedFile] {
+		u.t.storage().Delete(uploadedFile.Key)
+	}
+
+	u.releaseQuota(uploadedFile)
+}
+
+// postProcess runs the processing configured in t on a file just written to key
+func (u *upload) postProcess(key string, uploadedFile *UploadedFile) error {
+	if u.t.Scanner != nil {
+		if err := u.scan(key, uploadedFile); err != nil {
+			return err
+		}
+	}
+
+	if u.t.Archives != nil && isArchive(uploadedFile.DetectedType) {
+		if err := u.extractArchive(key, uploadedFile); err != nil {
+			return err
+		}
+	}
+
+	if u.t.Images != nil && isProcessableImage(uploadedFile.DetectedType) {
+		if err := u.processImage(key, uploadedFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveFile checks the type of the file read from src against AllowedFileTypes, detecting it from its first
+// bytes only, and copies it to the upload directory. src is read exactly once, so it can be a multipart.Part.
+// If the copy fails, whatever was already written is removed
+func (u *upload) saveFile(src io.Reader, field, fileName string, header textproto.MIMEHeader) (_ *UploadedFile, err error) {
+	t := u.t
+	var uploadedFile UploadedFile
+
+	if _, ok := t.FieldRules[field]; ok {
+		defer func() {
+			if err != nil {
+				err = &FieldError{Field: field, Err: err}
+			}
+		}()
+	}
+
+	limit, allowedFileTypes := u.fieldLimits(field)
 
-	if !allowed {
+	quota := int64(-1)
+	if u.tenant != "" {
+		usage, err := t.checkQuota(u.tenant, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		if usage.Quota.MaxBytes > 0 {
+			quota = usage.Quota.MaxBytes - usage.Bytes
+		}
+	}
+
+	src = &uploadLimitReader{r: src, u: u, fileName: fileName, limit: limit, quota: quota}
+
+	buff := make([]byte, sniffLen)
+	n, err := io.ReadFull(src, buff)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	buff = buff[:n]
+
+	//check to see if the file type is permitted
+	fileType := t.fileTypes().Detect(buff)
+
+	if !fileTypeAllowed(allowedFileTypes, fileType) {
 		return nil, errors.New("the uploaded file type is not permitted")
 	}
 
-	_, err = inFile.Seek(0, 0)
+	uploadedFile.DetectedType = fileType.MIME
+	uploadedFile.DetectedExtension = fileType.Extension
+
+	uploadedFile.OriginalFileName = fileName
+	uploadedFile.FieldName = field
+	uploadedFile.ContentType = header.Get("Content-Type")
+	uploadedFile.Header = header
+
+	// a renamed or content addressed file only keeps the extension of its name, so a name that cannot be
+	// sanitised does not matter then
+	safeName, err := t.SanitizeFileName(fileName)
+	if err != nil && !u.renameFile && !t.ContentAddressed {
+		return nil, err
+	}
+
+	ext, err := t.storedExtension(safeName, header.Get("Content-Type"), fileType, u.renameFile)
 	if err != nil {
 		return nil, err
 	}
 
-	uploadedFile.OriginalFileName = header.Filename
+	switch {
+	case t.ContentAddressed:
+		// named after its digest, once it is known
+	case u.renameFile:
+		uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), ext)
+	default:
+		uploadedFile.NewFileName, err = u.availableName(strings.TrimSuffix(safeName, filepath.Ext(safeName)) + ext)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	if renameFile {
-		uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), filepath.Ext(header.Filename))
+	// files are written to a temporary key when they must not be visible under their name right away
+	key := storageKey(u.uploadDir, uploadedFile.NewFileName)
+	var replaced *replacedFile
+	if t.TransactionalUploads || t.ContentAddressed || t.Scanner != nil {
+		key = storageKey(u.uploadDir, fmt.Sprintf(".%s.upload", t.RandomString(20)))
 	} else {
-		uploadedFile.NewFileName = header.Filename
+		replaced = u.replacing(key)
 	}
 
-	var outfile *os.File
-	defer outfile.Close()
+	sha256Hash, md5Hash := sha256.New(), md5.New()
+	digests := io.Writer(sha256Hash)
+	if t.ComputeMD5 {
+		digests = io.MultiWriter(sha256Hash, md5Hash)
+	}
 
-	if outfile, err = os.Create(filepath.Join(uploadDir, uploadedFile.NewFileName)); err != nil {
+	// the sniffed bytes were already consumed from src, so they are written back first
+	info, err := t.storage().Put(key, io.TeeReader(io.MultiReader(bytes.NewReader(buff), src), digests))
+	if err != nil {
+		t.storage().Delete(key)
 		return nil, err
-	} else {
-		fileSize, err := io.Copy(outfile, inFile)
-		if err != nil {
+	}
+	uploadedFile.FileSize = info.Size
+	uploadedFile.Key = info.Key
+	uploadedFile.ETag = info.ETag
+	u.releaseReplaced(replaced)
+	uploadedFile.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	if t.ComputeMD5 {
+		uploadedFile.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	}
+
+	if t.ContentAddressed {
+		uploadedFile.NewFileName = uploadedFile.SHA256 + ext
+	}
+
+	if err := u.postProcess(key, &uploadedFile); err != nil {
+		if !t.TransactionalUploads {
+			u.remove(&uploadedFile)
+		}
+		t.storage().Delete(key)
+		return nil, err
+	}
+
+	switch {
+	case t.TransactionalUploads:
+		uploadedFile.Key = storageKey(u.uploadDir, uploadedFile.NewFileName)
+		u.pending = append(u.pending, pendingFile{tempKey: key, file: &uploadedFile})
+	case t.ContentAddressed:
+		if err := u.placeContentAddressed(key, &uploadedFile); err != nil {
+			return nil, err
+		}
+	case t.Scanner != nil:
+		finalKey := storageKey(u.uploadDir, uploadedFile.NewFileName)
+		replaced := u.replacing(finalKey)
+		if err := moveObject(t.storage(), key, finalKey); err != nil {
+			u.remove(&uploadedFile)
 			return nil, err
 		}
-		uploadedFile.FileSize = fileSize
+		uploadedFile.Key = finalKey
+		u.releaseReplaced(replaced)
 	}
 
-	uploadedFiles = append(uploadedFiles, &uploadedFile)
-	return uploadedFiles, nil
+	if err := u.reserveQuota(&uploadedFile); err != nil {
+		// in transactional mode, the file is still pending and goes away with the rollback
+		if !t.TransactionalUploads {
+			u.remove(&uploadedFile)
+		}
+		return nil, err
+	}
+
+	return &uploadedFile, nil
+}
+
+// UploadProgress reports how much of an upload request has been written
+type UploadProgress struct {
+	// FileName is the name of the file being written, as sent by the client
+	FileName string
+	// FileWritten is the number of bytes of that file written so far
+	FileWritten int64
+	// TotalWritten is the number of bytes of all the files of the request written so far
+	TotalWritten int64
+	// Total is the length of the request body, or -1 when it is not known. It includes the multipart
+	// boundaries and headers, so TotalWritten never quite reaches it
+	Total int64
+}
+
+// ProgressFunc is called by UploadFilesContext and UploadFilesStreamContext each time more of a file is
+// written. It is called from the goroutine handling the request, so it should return quickly
+type ProgressFunc func(progress UploadProgress)
+
+// uploadLimitReader counts the bytes read from an uploaded file, failing as soon as the file goes over
+// MaxFileSize or the whole request goes over MaxUploadSize
+type uploadLimitReader struct {
+	r        io.Reader
+	u        *upload
+	fileName string
+	limit    int64
+	// quota is what is left of the quota of the tenant, or -1 when there is none
+	quota int64
+	n     int64
+}
+
+func (l *uploadLimitReader) Read(p []byte) (int, error) {
+	if err := l.u.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	l.u.written += int64(n)
+
+	if l.u.progress != nil && n > 0 {
+		l.u.progress(UploadProgress{FileName: l.fileName, FileWritten: l.n, TotalWritten: l.u.written, Total: l.u.total})
+	}
+
+	if l.n > l.limit {
+		return n, &FileTooLargeError{FileName: l.fileName, Limit: l.limit}
+	}
+
+	if l.quota >= 0 && l.n > l.quota {
+		return n, ErrQuotaExceeded
+	}
+
+	if limit := int64(l.u.t.MaxUploadSize); limit > 0 && l.u.written > limit {
+		return n, ErrRequestTooLarge
+	}
+
+	return n, err
+}
+
+func (t *Tools) maxFileSize() int64 {
+	if t.MaxFileSize > 0 {
+		return int64(t.MaxFileSize)
+	}
+	return int64(math.Pow(1024, 3))
+}
+
+// multipartError tells a request that went over the limits of the multipart reader apart from
+// one that is simply malformed
+func multipartError(err error) error {
+	if errors.Is(err, multipart.ErrMessageTooLarge) {
+		return ErrRequestTooLarge
+	}
+	return fmt.Errorf("%w: %s", ErrMalformedMultipart, err)
 }
 
 func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	return t.UploadFilesContext(r.Context(), r, uploadDir, nil, rename...)
+}
+
+// UploadFilesContext uploads the files in the request like UploadFiles does, calling progress, when it is
+// not nil, as they are written. The upload stops as soon as ctx is cancelled, returning ctx.Err(), and the
+// file being written at the time is removed
+func (t *Tools) UploadFilesContext(ctx context.Context, r *http.Request, uploadDir string, progress ProgressFunc, rename ...bool) ([]*UploadedFile, error) {
 	renameFile := shouldRenameFile(rename...)
 
+	u := &upload{t: t, ctx: ctx, tenant: t.quotaTenant(r), uploadDir: uploadDir, renameFile: renameFile, progress: progress, total: r.ContentLength}
+
+	return u.parseAndSave(r)
+}
+
+// parseAndSave parses the multipart form of r and saves its files, in the order they appear in the request
+func (u *upload) parseAndSave(r *http.Request) ([]*UploadedFile, error) {
+	t := u.t
+
 	var uploadedFiles []*UploadedFile
 
-	if t.MaxFileSize == 0 {
-		t.MaxFileSize = int(math.Pow(1024, 3))
+	if t.Storage == nil {
+		err := t.CreateDirIfNotExists(u.uploadDir)
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err := t.CreateDirIfNotExists(uploadDir)
+	var files []*formFile
+	var values url.Values
 
-	if err != nil {
+	if r.MultipartForm != nil {
+		files, values = parsedFormFiles(r.MultipartForm), r.MultipartForm.Value
+	} else {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return nil, multipartError(err)
+		}
+
+		if files, values, err = u.readForm(reader, t.maxFileSize()); err != nil {
+			return nil, err
+		}
+		defer removeFormFiles(files)
+	}
+
+	if t.DigestField != "" {
+		u.expectedDigests = values[t.DigestField]
+	}
+
+	var headers []*formFile
+	for _, f := range files {
+		if u.onlyField == "" || f.field == u.onlyField {
+			headers = append(headers, f)
+		}
+	}
+
+	// the number of files in each field is known up front, so nothing is saved when it is wrong
+	for _, h := range headers {
+		if err := u.countFile(h.field); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := u.checkFieldCounts(); err != nil {
 		return nil, err
 	}
 
-	err = r.ParseMultipartForm(int64(t.MaxFileSize))
+	// the sizes of the files are known too, so a request that does not fit in the quota is rejected
+	// before anything is written
+	if u.tenant != "" {
+		var size int64
+		for _, h := range headers {
+			size += h.size
+		}
+		if _, err := t.checkQuota(u.tenant, size, int64(len(headers))); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, h := range headers {
+		var err error
+		uploadedFiles, err = uploadFiles(UploadFilesParams{uploadedFiles, h, u})
+		if err != nil {
+			return u.finish(uploadedFiles, err)
+		}
+	}
+	return u.finish(uploadedFiles, nil)
+}
+
+// UploadFilesStream uploads the files in the request like UploadFiles does, but reads the multipart body
+// one part at a time with r.MultipartReader, writing each file straight to uploadDir. Unlike UploadFiles,
+// nothing is buffered in memory or spooled to temporary files, so it is suited to very large uploads.
+// Form fields that are not files are skipped
+func (t *Tools) UploadFilesStream(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	return t.UploadFilesStreamContext(r.Context(), r, uploadDir, nil, rename...)
+}
+
+// UploadFilesStreamContext is UploadFilesStream with the progress reporting and cancellation of
+// UploadFilesContext. A client that goes away cancels the request context, so passing r.Context() stops
+// the upload when that happens
+func (t *Tools) UploadFilesStreamContext(ctx context.Context, r *http.Request, uploadDir string, progress ProgressFunc, rename ...bool) ([]*UploadedFile, error) {
+	renameFile := shouldRenameFile(rename...)
+
+	if t.Storage == nil {
+		err := t.CreateDirIfNotExists(uploadDir)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reader, err := r.MultipartReader()
 
 	if err != nil {
-		return nil, errors.New("the uploaded file is too big")
+		return nil, multipartError(err)
 	}
 
-	for _, fHeaders := range r.MultipartForm.File {
-		for _, header := range fHeaders {
-			uploadedFiles, err = uploadFiles(UploadFilesParams{uploadedFiles, header, t, renameFile, uploadDir})
+	u := &upload{t: t, ctx: ctx, tenant: t.quotaTenant(r), uploadDir: uploadDir, renameFile: renameFile, progress: progress, total: r.ContentLength}
+
+	return u.stream(reader, nil)
+}
+
+// stream saves the files read from reader, one part at a time. The values of the parts that are not files
+// are added to values, unless it is nil
+func (u *upload) stream(reader *multipart.Reader, values url.Values) ([]*UploadedFile, error) {
+	var uploadedFiles []*UploadedFile
+	var valuesSize int64
+	position := 0
+
+	for {
+		if err := u.ctx.Err(); err != nil {
+			return u.finish(uploadedFiles, err)
+		}
+
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return u.finish(uploadedFiles, multipartError(err))
+		}
+
+		if part.FileName() == "" {
+			isDigest := u.t.DigestField != "" && part.FormName() == u.t.DigestField
+			if !isDigest && values == nil {
+				part.Close()
+				continue
+			}
+
+			limit := u.t.maxFormValuesSize() - valuesSize
+			if values == nil {
+				limit = 1024
+			}
+
+			value, err := io.ReadAll(io.LimitReader(part, limit+1))
+			part.Close()
 			if err != nil {
-				return uploadedFiles, err
+				return u.finish(uploadedFiles, multipartError(err))
+			}
+			if int64(len(value)) > limit {
+				return u.finish(uploadedFiles, fmt.Errorf("%w: the form values are over %d bytes", ErrRequestTooLarge, u.t.maxFormValuesSize()))
+			}
+
+			if isDigest {
+				u.expectedDigests = append(u.expectedDigests, string(value))
+			}
+			if values != nil {
+				valuesSize += int64(len(value))
+				values.Add(part.FormName(), string(value))
 			}
+			continue
 		}
+
+		if err := u.countFile(part.FormName()); err != nil {
+			part.Close()
+			return u.finish(uploadedFiles, err)
+		}
+
+		uploadedFile, err := u.saveFile(part, part.FormName(), part.FileName(), part.Header)
+		part.Close()
+		if err != nil {
+			return u.finish(uploadedFiles, err)
+		}
+
+		u.setPosition(uploadedFile, position)
+		position++
+		uploadedFiles = append(uploadedFiles, uploadedFile)
 	}
-	return uploadedFiles, nil
+	return u.finish(uploadedFiles, u.checkFieldCounts())
 }
 
+// UploadOneFile uploads the single file in the request, failing with ErrTooManyFiles when there is more
+// than one and with ErrTooFewFiles when there is none
 func (t *Tools) UploadOneFile(r *http.Request, uploadDir string, rename ...bool) (*UploadedFile, error) {
+	return t.UploadOneFileField(r, uploadDir, "", rename...)
+}
+
+// UploadOneFileField is UploadOneFile for the files of a single form field. Files in other fields are
+// ignored. When field is empty, the files of every field are considered
+func (t *Tools) UploadOneFileField(r *http.Request, uploadDir, field string, rename ...bool) (*UploadedFile, error) {
 	renameFile := shouldRenameFile(rename...)
 
-	files, err := t.UploadFiles(r, uploadDir, renameFile)
+	u := &upload{t: t, ctx: r.Context(), tenant: t.quotaTenant(r), uploadDir: uploadDir, renameFile: renameFile, total: r.ContentLength, onlyField: field, maxFiles: 1}
+
+	files, err := u.parseAndSave(r)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if len(files) == 0 {
+		return nil, u.fileCountError(ErrTooFewFiles, "one file required")
+	}
+
 	return files[0], nil
 }
 
@@ -205,12 +878,21 @@ func (t *Tools) Slugify(s string) (string, error) {
 }
 
 // DownloadsStatic File downloads a file and tries to force the browser to avoid displaying it in the browser window by setting content disposition.
-// It also alllows specification of the display name
+// It also alllows specification of the display name. When t.Storage is set, the file is read from it instead of the local filesystem.
+// fileName cannot reach outside pathName, see DownloadFromFS
 func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, fileName, displayName string) {
-	fp := path.Join(pathName, fileName)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+	if t.Storage == nil {
+		t.DownloadFromDir(w, r, pathName, fileName, displayName)
+		return
+	}
+
+	name, ok := confinedName(fileName)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
-	http.ServeFile(w, r, fp)
+	t.DownloadObject(w, r, storageKey(pathName, name), displayName)
 }
 
 // JSONResponse is the type used for sending JSON around
@@ -220,7 +902,7 @@ type JSONResponse struct {
 	Data    interface{} `json:"data,omitempty"`
 }
 
-// ReadJSON tries to read the body of a request and converts from json into a go data variable
+// ReadJson tries to read the body of a request and converts from json into a go data variable
 func (t *Tools) ReadJson(w http.ResponseWriter, r *http.Request, data interface{}) error {
 	maxBytes := 1024 * 1024 // one mega
 
@@ -290,6 +972,7 @@ func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, h
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
 	w.WriteHeader(status)
 	_, err = w.Write(out)
 	if err != nil {
@@ -298,6 +981,29 @@ func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, h
 	return nil
 }
 
+// ReadJSON reads the JSON body of r into a new value of type T, with the limits and the error messages of
+// t.ReadJson. A nil t uses the defaults
+//
+//	payload, err := toolkit.ReadJSON[Payload](&tools, w, r)
+func ReadJSON[T any](t *Tools, w http.ResponseWriter, r *http.Request) (T, error) {
+	if t == nil {
+		t = &Tools{}
+	}
+
+	var data T
+	err := t.ReadJson(w, r, &data)
+	return data, err
+}
+
+// WriteJSON writes data as JSON with the given status code, like t.WriteJSON, but only accepts values of
+// type T. A nil t uses the defaults
+func WriteJSON[T any](t *Tools, w http.ResponseWriter, status int, data T, headers ...http.Header) error {
+	if t == nil {
+		t = &Tools{}
+	}
+	return t.WriteJSON(w, status, data, headers...)
+}
+
 // ErrorJSON takes an error and optionally a status code, and generates and sends a JSON error message
 func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
 	statusCode := http.StatusBadRequest
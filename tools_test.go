@@ -2,16 +2,20 @@ package toolkit
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/png"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -157,6 +161,514 @@ func TestTools_UploadOneFile(t *testing.T) {
 
 }
 
+func TestTools_UploadFilesOrder(t *testing.T) {
+	uploaders := map[string]func(*Tools, *http.Request) ([]*UploadedFile, error){
+		"UploadFiles": func(tools *Tools, r *http.Request) ([]*UploadedFile, error) {
+			return tools.UploadFiles(r, "uploads")
+		},
+		"UploadFilesStream": func(tools *Tools, r *http.Request) ([]*UploadedFile, error) {
+			return tools.UploadFilesStream(r, "uploads")
+		},
+	}
+
+	for name, upload := range uploaders {
+		testTools := Tools{Storage: &MemoryStorage{}}
+
+		request := newUploadRequest(t,
+			testPart{field: "zeta", fileName: "1.txt", contentType: "text/plain", content: []byte("one")},
+			testPart{field: "alpha", fileName: "2.txt", content: []byte("two")},
+			testPart{field: "title", content: []byte("not a file")},
+			testPart{field: "zeta", fileName: "3.txt", content: []byte("three")},
+			testPart{field: "mid", fileName: "4.txt", content: []byte("four")},
+		)
+
+		uploadedFiles, err := upload(&testTools, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var order []string
+		for _, f := range uploadedFiles {
+			order = append(order, f.FieldName+"/"+f.OriginalFileName)
+		}
+
+		if strings.Join(order, ",") != "zeta/1.txt,alpha/2.txt,zeta/3.txt,mid/4.txt" {
+			t.Errorf("%s: files not returned in request order: %v", name, order)
+		}
+
+		if uploadedFiles[0].ContentType != "text/plain" || !strings.Contains(uploadedFiles[0].Header.Get("Content-Disposition"), `filename="1.txt"`) {
+			t.Errorf("%s: wrong part metadata: %q %v", name, uploadedFiles[0].ContentType, uploadedFiles[0].Header)
+		}
+	}
+
+	// a form parsed before the upload falls back to the order of the fields
+	testTools := Tools{Storage: &MemoryStorage{}}
+
+	request := newUploadRequest(t,
+		testPart{field: "zeta", fileName: "1.txt", content: []byte("one")},
+		testPart{field: "alpha", fileName: "2.txt", content: []byte("two")},
+	)
+	if err := request.ParseMultipartForm(1024); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadedFiles, err := testTools.UploadFiles(request, "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploadedFiles[0].FieldName != "alpha" || uploadedFiles[1].FieldName != "zeta" {
+		t.Errorf("expected files sorted by field, but got %s, %s", uploadedFiles[0].FieldName, uploadedFiles[1].FieldName)
+	}
+}
+
+func TestTools_UploadOneFileField(t *testing.T) {
+	var store MemoryStorage
+	testTools := Tools{Storage: &store}
+
+	request := newUploadRequest(t,
+		testPart{field: "attachment", fileName: "a.txt", content: []byte("attachment")},
+		testPart{field: "avatar", fileName: "me.png", content: testPNG(t, 2, 2)},
+	)
+
+	uploadedFile, err := testTools.UploadOneFileField(request, "uploads", "avatar", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploadedFile.OriginalFileName != "me.png" {
+		t.Errorf("expected the avatar to be uploaded, but got %s", uploadedFile.OriginalFileName)
+	}
+	if saved, _ := store.List("uploads/"); len(saved) != 1 {
+		t.Errorf("expected files in other fields to be ignored, but found %d saved", len(saved))
+	}
+
+	request = newUploadRequest(t,
+		testPart{field: "attachment", fileName: "a.txt", content: []byte("attachment")},
+		testPart{field: "avatar", fileName: "me.png", content: testPNG(t, 2, 2)},
+	)
+	if _, err := testTools.UploadOneFile(request, "more"); !errors.Is(err, ErrTooManyFiles) {
+		t.Errorf("expected ErrTooManyFiles, but got %v", err)
+	}
+	if saved, _ := store.List("more/"); len(saved) != 0 {
+		t.Errorf("expected nothing to be saved, but found %d files", len(saved))
+	}
+
+	request = newUploadRequest(t, testPart{field: "attachment", fileName: "a.txt", content: []byte("attachment")})
+
+	var fieldErr *FieldError
+	if _, err := testTools.UploadOneFileField(request, "uploads", "avatar"); !errors.Is(err, ErrTooFewFiles) || !errors.As(err, &fieldErr) || fieldErr.Field != "avatar" {
+		t.Errorf("expected ErrTooFewFiles for avatar, but got %v", err)
+	}
+}
+
+func TestTools_UploadFilesStream(t *testing.T) {
+	for _, entry := range uploadTests {
+		// set up a pipe to avoid buffering
+		pr, pw := io.Pipe()
+		writer := multipart.NewWriter(pw)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+
+		go func() {
+			defer pw.Close()
+			defer writer.Close()
+			defer wg.Done()
+
+			// a plain form field before the file, which should be skipped
+			err := writer.WriteField("name", "some value")
+			if err != nil {
+				t.Error(err)
+			}
+
+			// create the form data field 'file'
+			part, err := writer.CreateFormFile("file", "./testdata/img.png")
+			if err != nil {
+				t.Error(err)
+			}
+
+			f, err := os.Open("./testdata/img.png")
+			if err != nil {
+				t.Error(err)
+			}
+			defer f.Close()
+
+			img, _, err := image.Decode(f)
+			if err != nil {
+				t.Error("error decoding image", err)
+			}
+
+			err = png.Encode(part, img)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+
+		request := httptest.NewRequest("POST", "/", pr)
+		request.Header.Add("Content-Type", writer.FormDataContentType())
+
+		var testTools Tools
+
+		testTools.AllowedFileTypes = entry.allowedTypes
+
+		uploadedFiles, err := testTools.UploadFilesStream(request, "./testdata/uploads/", entry.renameFile)
+
+		if err != nil && !entry.errorExpected {
+			t.Error(err)
+		}
+
+		if !entry.errorExpected {
+			if len(uploadedFiles) != 1 {
+				t.Fatalf("%s: expected 1 uploaded file, but got %d", entry.name, len(uploadedFiles))
+			}
+
+			if _, err := os.Stat(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].NewFileName)); os.IsNotExist(err) {
+				t.Errorf("%s: expected file to exists: %s", entry.name, err.Error())
+			}
+
+			// clean up
+			os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].NewFileName))
+		}
+
+		if entry.errorExpected && err == nil {
+			t.Errorf("%s: error expected but none received", entry.name)
+		}
+
+		// drain whatever the upload did not read so the writer can finish
+		io.Copy(io.Discard, pr)
+		wg.Wait()
+	}
+}
+
+// testPart describes one part of the body built by newUploadRequest. Parts without a fileName are
+// written as plain form fields
+type testPart struct {
+	field       string
+	fileName    string
+	contentType string
+	content     []byte
+}
+
+// newUploadRequest builds a multipart/form-data POST request holding parts, in order
+func newUploadRequest(t *testing.T, parts ...testPart) *http.Request {
+	t.Helper()
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+
+	for _, p := range parts {
+		if p.fileName == "" {
+			if err := writer.WriteField(p.field, string(p.content)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, p.field, p.fileName))
+		if p.contentType != "" {
+			h.Set("Content-Type", p.contentType)
+		} else {
+			h.Set("Content-Type", "application/octet-stream")
+		}
+
+		part, err := writer.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := part.Write(p.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	return request
+}
+
+// testPNG returns a small png image, encoded in memory
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var uploadLimitTests = []struct {
+	name          string
+	maxFileSize   int
+	maxUploadSize int
+	files         []int
+	expectedErr   error
+	expectedSaved int
+}{
+	{name: "within limits", maxFileSize: 100, maxUploadSize: 300, files: []int{100, 100}, expectedErr: nil, expectedSaved: 2},
+	{name: "file too large", maxFileSize: 100, maxUploadSize: 0, files: []int{101}, expectedErr: ErrFileTooLarge, expectedSaved: 0},
+	{name: "request too large", maxFileSize: 100, maxUploadSize: 150, files: []int{100, 100}, expectedErr: ErrRequestTooLarge, expectedSaved: 1},
+}
+
+func TestTools_UploadFilesLimits(t *testing.T) {
+	uploaders := map[string]func(*Tools, *http.Request) ([]*UploadedFile, error){
+		"UploadFiles": func(tools *Tools, r *http.Request) ([]*UploadedFile, error) {
+			return tools.UploadFiles(r, "uploads")
+		},
+		"UploadFilesStream": func(tools *Tools, r *http.Request) ([]*UploadedFile, error) {
+			return tools.UploadFilesStream(r, "uploads")
+		},
+	}
+
+	for uploaderName, upload := range uploaders {
+		for _, entry := range uploadLimitTests {
+			var store MemoryStorage
+			testTools := Tools{Storage: &store, MaxFileSize: entry.maxFileSize, MaxUploadSize: entry.maxUploadSize}
+
+			var parts []testPart
+			for i, size := range entry.files {
+				parts = append(parts, testPart{field: "file", fileName: fmt.Sprintf("file%d.txt", i), content: bytes.Repeat([]byte("a"), size)})
+			}
+
+			_, err := upload(&testTools, newUploadRequest(t, parts...))
+
+			if !errors.Is(err, entry.expectedErr) {
+				t.Errorf("%s, %s: expected error %v, but got %v", uploaderName, entry.name, entry.expectedErr, err)
+			}
+
+			var tooLarge *FileTooLargeError
+			if errors.As(err, &tooLarge) && (tooLarge.FileName != "file0.txt" || tooLarge.Limit != int64(entry.maxFileSize)) {
+				t.Errorf("%s, %s: wrong file or limit reported: %+v", uploaderName, entry.name, tooLarge)
+			}
+
+			// files that went over a limit must not be left behind
+			saved, _ := store.List("uploads/")
+			if len(saved) != entry.expectedSaved {
+				t.Errorf("%s, %s: expected %d saved files, but found %d", uploaderName, entry.name, entry.expectedSaved, len(saved))
+			}
+		}
+
+		request := httptest.NewRequest("POST", "/", strings.NewReader("this is not a multipart body"))
+		request.Header.Set("Content-Type", "multipart/form-data; boundary=xyz")
+
+		testTools := Tools{Storage: &MemoryStorage{}}
+		if _, err := upload(&testTools, request); !errors.Is(err, ErrMalformedMultipart) {
+			t.Errorf("%s: expected ErrMalformedMultipart, but got %v", uploaderName, err)
+		}
+	}
+}
+
+func TestTools_TransactionalUploads(t *testing.T) {
+	storages := map[string]Storage{
+		"memory": &MemoryStorage{},
+		"local":  LocalStorage{Root: t.TempDir()},
+	}
+
+	for name, store := range storages {
+		for _, transactional := range []bool{true, false} {
+			testTools := Tools{Storage: store, AllowedFileTypes: []string{"image/png"}, TransactionalUploads: transactional}
+
+			request := newUploadRequest(t,
+				testPart{field: "file", fileName: "one.png", content: testPNG(t, 4, 4)},
+				testPart{field: "file", fileName: "two.png", content: testPNG(t, 4, 4)},
+				testPart{field: "file", fileName: "three.txt", content: []byte("not an image")},
+			)
+
+			uploadedFiles, err := testTools.UploadFilesStream(request, "failed", false)
+			if err == nil {
+				t.Errorf("%s, transactional %t: error expected but none received", name, transactional)
+			}
+
+			saved, _ := store.List("failed/")
+
+			if transactional && (len(saved) != 0 || uploadedFiles != nil) {
+				t.Errorf("%s: expected nothing to be kept after a failure, but found %d files", name, len(saved))
+			}
+
+			if !transactional && len(saved) != 2 {
+				t.Errorf("%s: expected the files before the failure to be kept, but found %d files", name, len(saved))
+			}
+		}
+
+		testTools := Tools{Storage: store, TransactionalUploads: true}
+
+		request := newUploadRequest(t,
+			testPart{field: "file", fileName: "one.png", content: testPNG(t, 4, 4)},
+			testPart{field: "file", fileName: "two.png", content: testPNG(t, 4, 4)},
+		)
+
+		uploadedFiles, err := testTools.UploadFiles(request, "committed", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		saved, _ := store.List("committed/")
+		if len(saved) != 2 || saved[0].Key != "committed/one.png" || saved[1].Key != "committed/two.png" {
+			t.Errorf("%s: wrong files kept after commit: %+v", name, saved)
+		}
+
+		for _, f := range uploadedFiles {
+			if _, err := store.Stat(f.Key); err != nil {
+				t.Errorf("%s: uploaded file reports a missing key: %s", name, err)
+			}
+		}
+	}
+}
+
+// failingRenameStorage fails to move anything to failKey
+type failingRenameStorage struct {
+	*MemoryStorage
+	failKey string
+}
+
+func (s failingRenameStorage) Rename(oldKey, newKey string) error {
+	if newKey == s.failKey {
+		return errors.New("rename failed")
+	}
+	return s.MemoryStorage.Rename(oldKey, newKey)
+}
+
+func TestTools_TransactionalUploadsRestoreReplaced(t *testing.T) {
+	store := failingRenameStorage{MemoryStorage: &MemoryStorage{}, failKey: "replaced/two.png"}
+	_, _ = store.Put("replaced/one.png", strings.NewReader("original"))
+
+	testTools := Tools{Storage: store, TransactionalUploads: true}
+
+	request := newUploadRequest(t,
+		testPart{field: "file", fileName: "one.png", content: testPNG(t, 4, 4)},
+		testPart{field: "file", fileName: "two.png", content: testPNG(t, 4, 4)},
+	)
+
+	if _, err := testTools.UploadFiles(request, "replaced", false); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+
+	saved, _ := store.List("replaced/")
+	if len(saved) != 1 || saved[0].Key != "replaced/one.png" {
+		t.Fatalf("expected only the original file to be left, but found %+v", saved)
+	}
+
+	obj, _ := store.Get("replaced/one.png")
+	content, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(content) != "original" {
+		t.Errorf("expected the replaced file to be restored, but got %q", content)
+	}
+
+	// two files of the request replacing each other still leave the original behind
+	store.failKey = "replaced/three.png"
+	testTools.Storage = store
+
+	request = newUploadRequest(t,
+		testPart{field: "file", fileName: "one.png", content: testPNG(t, 4, 4)},
+		testPart{field: "file", fileName: "one.png", content: testPNG(t, 8, 8)},
+		testPart{field: "file", fileName: "three.png", content: testPNG(t, 4, 4)},
+	)
+	if _, err := testTools.UploadFiles(request, "replaced", false); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+
+	obj, _ = store.Get("replaced/one.png")
+	content, _ = io.ReadAll(obj)
+	obj.Close()
+	if string(content) != "original" {
+		t.Errorf("expected the replaced file to be restored, but got %q", content)
+	}
+
+	// when the commit succeeds, the replaced file is gone for good
+	store.failKey = ""
+	testTools.Storage = store
+
+	request = newUploadRequest(t, testPart{field: "file", fileName: "one.png", content: testPNG(t, 4, 4)})
+	if _, err := testTools.UploadFiles(request, "replaced", false); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, _ = store.List("replaced/")
+	if len(saved) != 1 || saved[0].Size == int64(len("original")) {
+		t.Errorf("expected the new file alone, but found %+v", saved)
+	}
+}
+
+func TestTools_UploadFilesProgress(t *testing.T) {
+	testTools := Tools{Storage: &MemoryStorage{}}
+
+	request := newUploadRequest(t,
+		testPart{field: "file", fileName: "one.txt", content: bytes.Repeat([]byte("a"), 10000)},
+		testPart{field: "file", fileName: "two.txt", content: bytes.Repeat([]byte("b"), 10000)},
+	)
+
+	var reports []UploadProgress
+	progress := func(p UploadProgress) { reports = append(reports, p) }
+
+	if _, err := testTools.UploadFilesStreamContext(context.Background(), request, "uploads", progress); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports) < 2 {
+		t.Fatalf("expected progress to be reported for each file, but got %d reports", len(reports))
+	}
+
+	last := reports[len(reports)-1]
+	if last.FileName != "two.txt" || last.FileWritten != 10000 || last.TotalWritten != 20000 || last.Total != request.ContentLength {
+		t.Errorf("wrong final progress: %+v", last)
+	}
+}
+
+func TestTools_UploadFilesCancel(t *testing.T) {
+	uploaders := map[string]func(*Tools, context.Context, *http.Request, ProgressFunc) ([]*UploadedFile, error){
+		"UploadFilesContext": func(tools *Tools, ctx context.Context, r *http.Request, progress ProgressFunc) ([]*UploadedFile, error) {
+			return tools.UploadFilesContext(ctx, r, "uploads", progress)
+		},
+		"UploadFilesStreamContext": func(tools *Tools, ctx context.Context, r *http.Request, progress ProgressFunc) ([]*UploadedFile, error) {
+			return tools.UploadFilesStreamContext(ctx, r, "uploads", progress)
+		},
+	}
+
+	for name, upload := range uploaders {
+		var store MemoryStorage
+		testTools := Tools{Storage: &store}
+
+		request := newUploadRequest(t,
+			testPart{field: "file", fileName: "one.txt", content: bytes.Repeat([]byte("a"), 10000)},
+			testPart{field: "file", fileName: "two.txt", content: bytes.Repeat([]byte("b"), 10000)},
+		)
+
+		// cancel half way through the second file
+		ctx, cancel := context.WithCancel(context.Background())
+		progress := func(p UploadProgress) {
+			if p.TotalWritten > 15000 {
+				cancel()
+			}
+		}
+
+		uploadedFiles, err := upload(&testTools, ctx, request, progress)
+		cancel()
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: expected context.Canceled, but got %v", name, err)
+		}
+
+		if uploadedFiles != nil {
+			t.Errorf("%s: expected no files to be returned, but got %d", name, len(uploadedFiles))
+		}
+
+		if saved, _ := store.List("uploads/"); len(saved) != 0 {
+			t.Errorf("%s: expected nothing to be left after cancelling, but found %d files", name, len(saved))
+		}
+	}
+}
+
 func TestTools_CreateDirIfNotExists(t *testing.T) {
 	var testTool Tools
 
@@ -285,6 +797,62 @@ func TestTools_ReadJson(t *testing.T) {
 	}
 }
 
+func TestReadJSON(t *testing.T) {
+	type payload struct {
+		Foo string `json:"foo"`
+	}
+
+	for _, entry := range jsonTests {
+		testTool := Tools{MaxJSONSize: entry.maxSize, AllowUnknownFields: entry.allowUnknown}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(entry.json))
+		rr := httptest.NewRecorder()
+
+		decoded, err := ReadJSON[payload](&testTool, rr, req)
+
+		// the errors are the ones ReadJson returns
+		var expected payload
+		expectedErr := testTool.ReadJson(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(entry.json)), &expected)
+
+		if entry.errorExpected && err == nil {
+			t.Errorf("%s: error expected, but none received", entry.name)
+		}
+		if !entry.errorExpected && err != nil {
+			t.Errorf("%s: error not expected, but one received: %s", entry.name, err.Error())
+		}
+		if (err == nil) != (expectedErr == nil) || (err != nil && err.Error() != expectedErr.Error()) {
+			t.Errorf("%s: expected the error of ReadJson, %v, but got %v", entry.name, expectedErr, err)
+		}
+		if err == nil && decoded != expected {
+			t.Errorf("%s: expected %+v, but got %+v", entry.name, expected, decoded)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`[1, 2, 3]`))
+	numbers, err := ReadJSON[[]int](nil, httptest.NewRecorder(), req)
+	if err != nil || len(numbers) != 3 {
+		t.Errorf("expected three numbers, but got %v: %v", numbers, err)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	rr := httptest.NewRecorder()
+
+	err := WriteJSON(nil, rr, http.StatusCreated, JSONResponse{Message: "foo"})
+	if err != nil {
+		t.Fatalf("failed to write JSON: %v", err)
+	}
+
+	if rr.Code != http.StatusCreated || rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("wrong response: %d %v", rr.Code, rr.Header())
+	}
+
+	var payload JSONResponse
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil || payload.Message != "foo" {
+		t.Errorf("wrong body: %+v: %v", payload, err)
+	}
+}
+
 func TestTools_WriteJSON(t *testing.T) {
 	testTools := Tools{}
 
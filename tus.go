@@ -0,0 +1,502 @@
+package toolkit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tusVersion           = "1.0.0"
+	defaultTusExpiration = 24 * time.Hour
+)
+
+// TusOptions configures a TusServer
+type TusOptions struct {
+	// BasePath is the URL path the server is mounted on, such as "/files/". The URL of each upload
+	// is BasePath followed by its id
+	BasePath string
+	// PartialDir is the local directory unfinished uploads are kept in. It is created if it does not exist
+	PartialDir string
+	// UploadDir is where finished uploads are saved, through Tools.Storage as UploadFiles does
+	UploadDir string
+	// KeepFileName saves finished uploads with the file name sent in their metadata, sanitised, instead
+	// of a random one
+	KeepFileName bool
+	// MaxSize is the largest Upload-Length accepted. It defaults to Tools.MaxFileSize
+	MaxSize int64
+	// Expiration is how long an unfinished upload is kept after it was last written to. It defaults to 24 hours
+	Expiration time.Duration
+	// OnComplete, when set, is called with each finished upload
+	OnComplete func(r *http.Request, uploadedFile *UploadedFile)
+}
+
+// TusServer is an http.Handler implementing the core of the tus 1.0 resumable upload protocol, along with
+// its creation, termination and expiration extensions. Finished uploads go through the same checks as
+// the files sent to UploadFiles
+type TusServer struct {
+	t     *Tools
+	opts  TusOptions
+	locks sync.Map
+}
+
+// tusInfo is what the server keeps about an unfinished upload, next to its data
+type tusInfo struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Expires  time.Time         `json:"expires"`
+}
+
+// TusServer returns a tus server that saves finished uploads with t. See TusOptions
+func (t *Tools) TusServer(opts TusOptions) (*TusServer, error) {
+	if opts.PartialDir == "" {
+		return nil, errors.New("a directory for partial uploads is required")
+	}
+
+	if err := t.CreateDirIfNotExists(opts.PartialDir); err != nil {
+		return nil, err
+	}
+
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = t.maxFileSize()
+	}
+
+	if opts.Expiration <= 0 {
+		opts.Expiration = defaultTusExpiration
+	}
+
+	return &TusServer{t: t, opts: opts}, nil
+}
+
+// ServeHTTP handles the tus requests for the uploads under BasePath
+func (s *TusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = strings.ToUpper(override)
+	}
+
+	if method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination,expiration")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.opts.MaxSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, s.opts.BasePath), "/")
+
+	if method == http.MethodPost {
+		if id != "" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.create(w, r)
+		return
+	}
+
+	if !validTusID(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// HEAD only reads the info file, which is never seen half written, and the size of the data file, so
+	// it does not wait for the lock: a client resuming after a dropped connection asks for the offset
+	// while the server may still be writing the PATCH it gave up on
+	if method == http.MethodHead {
+		info, err := s.readInfo(id)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if time.Now().After(info.Expires) {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		s.head(w, info)
+		return
+	}
+
+	unlock, ok := s.lock(id)
+	if !ok {
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	defer unlock()
+
+	info, err := s.readInfo(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if time.Now().After(info.Expires) {
+		s.remove(id)
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	switch method {
+	case http.MethodPatch:
+		s.patch(w, r, info)
+	case http.MethodDelete:
+		s.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *TusServer) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	if length > s.opts.MaxSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if tenant := s.t.quotaTenant(r); tenant != "" {
+		if _, err := s.t.checkQuota(tenant, length, 1); errors.Is(err, ErrQuotaExceeded) {
+			s.t.ErrorJSON(w, err, http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	info := tusInfo{
+		ID:       hex.EncodeToString(idBytes),
+		Length:   length,
+		Metadata: metadata,
+		Expires:  time.Now().Add(s.opts.Expiration),
+	}
+
+	f, err := os.Create(s.dataPath(info.ID))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	if err := s.writeInfo(info); err != nil {
+		s.remove(info.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", path.Join(s.opts.BasePath, info.ID))
+	w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *TusServer) head(w http.ResponseWriter, info tusInfo) {
+	offset, err := s.offset(info.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	if len(info.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatTusMetadata(info.Metadata))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *TusServer) patch(w http.ResponseWriter, r *http.Request, info tusInfo) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := s.offset(info.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	requestOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || requestOffset != offset {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(s.dataPath(info.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// whatever arrives before the client goes away is kept, so the upload can resume from there
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, info.Length-offset))
+	closeErr := f.Close()
+	offset += n
+
+	if closeErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	info.Expires = time.Now().Add(s.opts.Expiration)
+	if err := s.writeInfo(info); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if copyErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if offset == info.Length {
+		uploadedFile, err := s.finish(r, info)
+		s.remove(info.ID)
+
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrFileTooLarge) || errors.Is(err, ErrRequestTooLarge) || errors.Is(err, ErrQuotaExceeded) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			s.t.ErrorJSON(w, err, status)
+			return
+		}
+
+		if s.opts.OnComplete != nil {
+			s.opts.OnComplete(r, uploadedFile)
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish saves a complete upload to UploadDir, the same way UploadFiles saves each file
+func (s *TusServer) finish(r *http.Request, info tusInfo) (*UploadedFile, error) {
+	f, err := os.Open(s.dataPath(info.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fileName := info.Metadata["filename"]
+	if fileName == "" {
+		fileName = info.Metadata["name"]
+	}
+	if fileName == "" {
+		fileName = info.ID
+	}
+
+	header := make(textproto.MIMEHeader)
+	if fileType := info.Metadata["filetype"]; fileType != "" {
+		header.Set("Content-Type", fileType)
+	}
+
+	if s.t.Storage == nil {
+		if err := s.t.CreateDirIfNotExists(s.opts.UploadDir); err != nil {
+			return nil, err
+		}
+	}
+
+	u := &upload{t: s.t, ctx: context.Background(), tenant: s.t.quotaTenant(r), uploadDir: s.opts.UploadDir, renameFile: !s.opts.KeepFileName}
+
+	uploadedFile, err := u.saveFile(f, "", fileName, header)
+	if err != nil {
+		_, err = u.finish(nil, err)
+		return nil, err
+	}
+
+	uploadedFiles, err := u.finish([]*UploadedFile{uploadedFile}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return uploadedFiles[0], nil
+}
+
+// PurgeExpired removes the unfinished uploads that expired. Expired uploads are also removed when a
+// client asks for them, so this is only needed to reclaim the space of the ones that are abandoned
+func (s *TusServer) PurgeExpired() error {
+	entries, err := os.ReadDir(s.opts.PartialDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".info")
+		if id == entry.Name() || !validTusID(id) {
+			continue
+		}
+
+		// uploads in use are left to the requests using them
+		unlock, ok := s.lock(id)
+		if !ok {
+			continue
+		}
+
+		info, err := s.readInfo(id)
+		if err == nil && time.Now().After(info.Expires) {
+			s.remove(id)
+		}
+		unlock()
+	}
+
+	return nil
+}
+
+func (s *TusServer) offset(id string) (int64, error) {
+	fi, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (s *TusServer) readInfo(id string) (tusInfo, error) {
+	var info tusInfo
+
+	data, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		return info, err
+	}
+
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// writeInfo replaces the info file through a rename, so it is never seen half written
+func (s *TusServer) writeInfo(info tusInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.infoPath(info.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.infoPath(info.ID))
+}
+
+// lock takes the lock of the upload id, reporting false when another request holds it. The returned
+// function releases it, and forgets it once the upload is removed. Ids are never reused, so a request
+// that still finds the forgotten lock can only find the upload gone
+func (s *TusServer) lock(id string) (func(), bool) {
+	value, _ := s.locks.LoadOrStore(id, &sync.Mutex{})
+	lock := value.(*sync.Mutex)
+	if !lock.TryLock() {
+		return nil, false
+	}
+
+	return func() {
+		lock.Unlock()
+		if _, err := os.Stat(s.infoPath(id)); errors.Is(err, fs.ErrNotExist) {
+			s.locks.Delete(id)
+		}
+	}, true
+}
+
+// remove deletes the files of the upload id, whose lock must be held
+func (s *TusServer) remove(id string) {
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+}
+
+func (s *TusServer) dataPath(id string) string {
+	return filepath.Join(s.opts.PartialDir, id+".bin")
+}
+
+func (s *TusServer) infoPath(id string) string {
+	return filepath.Join(s.opts.PartialDir, id+".info")
+}
+
+// validTusID reports whether id looks like an id made by the server, which keeps ids taken from the
+// URL from reaching outside PartialDir
+func validTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs of a key and an optional
+// base64 encoded value
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			metadata[fields[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("invalid metadata pair %q", pair)
+		}
+	}
+
+	return metadata, nil
+}
+
+func formatTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+
+	return strings.Join(pairs, ",")
+}
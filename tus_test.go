@@ -0,0 +1,212 @@
+package toolkit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func tusRequest(t *testing.T, server http.Handler, method, url string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, url, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTusServer(t *testing.T) {
+	var store MemoryStorage
+	var completed *UploadedFile
+
+	testTools := Tools{Storage: &store}
+
+	server, err := testTools.TusServer(TusOptions{
+		BasePath:     "/files/",
+		PartialDir:   t.TempDir(),
+		UploadDir:    "uploads",
+		KeepFileName: true,
+		OnComplete:   func(r *http.Request, uploadedFile *UploadedFile) { completed = uploadedFile },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := testPNG(t, 8, 8)
+	half := len(content) / 2
+
+	rr := tusRequest(t, server, http.MethodOptions, "/files/", nil, nil)
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Tus-Extension") != "creation,termination,expiration" {
+		t.Errorf("wrong options response: %d %v", rr.Code, rr.Header())
+	}
+
+	rr = tusRequest(t, server, http.MethodPost, "/files/", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("img.png")) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("image/png")),
+	}, nil)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 on creation, but got %d", rr.Code)
+	}
+
+	location := rr.Header().Get("Location")
+	if rr.Header().Get("Upload-Expires") == "" {
+		t.Error("expected Upload-Expires on creation")
+	}
+
+	patch := func(offset int, body []byte) *httptest.ResponseRecorder {
+		return tusRequest(t, server, http.MethodPatch, location, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}, body)
+	}
+
+	if rr = patch(0, content[:half]); rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("wrong response to first patch: %d %s", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	rr = tusRequest(t, server, http.MethodHead, location, nil, nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != strconv.Itoa(half) || rr.Header().Get("Upload-Length") != strconv.Itoa(len(content)) {
+		t.Errorf("wrong head response: %d %v", rr.Code, rr.Header())
+	}
+
+	if rr = patch(0, content[half:]); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a wrong offset, but got %d", rr.Code)
+	}
+
+	if completed != nil {
+		t.Fatal("upload completed too early")
+	}
+
+	if rr = patch(half, content[half:]); rr.Code != http.StatusNoContent {
+		t.Fatalf("wrong response to last patch: %d %s", rr.Code, rr.Body.String())
+	}
+
+	if completed == nil || completed.NewFileName != "img.png" || completed.DetectedType != "image/png" || completed.FileSize != int64(len(content)) {
+		t.Fatalf("wrong completed upload: %+v", completed)
+	}
+
+	obj, err := store.Get("uploads/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(obj)
+	obj.Close()
+	if !bytes.Equal(data, content) {
+		t.Error("stored file does not match the uploaded content")
+	}
+
+	if rr = tusRequest(t, server, http.MethodHead, location, nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected finished upload to be gone, but got %d", rr.Code)
+	}
+}
+
+func TestTusServer_Termination(t *testing.T) {
+	testTools := Tools{Storage: &MemoryStorage{}}
+
+	server, err := testTools.TusServer(TusOptions{BasePath: "/files/", PartialDir: t.TempDir(), MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/files/", nil)
+	req.Header.Set("Upload-Length", "10")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 without Tus-Resumable, but got %d", rr.Code)
+	}
+
+	if rr = tusRequest(t, server, http.MethodPost, "/files/", map[string]string{"Upload-Length": "101"}, nil); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 over MaxSize, but got %d", rr.Code)
+	}
+
+	rr = tusRequest(t, server, http.MethodPost, "/files/", map[string]string{"Upload-Length": "10"}, nil)
+	location := rr.Header().Get("Location")
+
+	if rr = tusRequest(t, server, http.MethodDelete, location, nil, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("expected 204 on termination, but got %d", rr.Code)
+	}
+
+	if rr = tusRequest(t, server, http.MethodHead, location, nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after termination, but got %d", rr.Code)
+	}
+
+	if rr = tusRequest(t, server, http.MethodHead, "/files/../../etc/passwd", nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an invalid id, but got %d", rr.Code)
+	}
+}
+
+func TestTusServer_Expiration(t *testing.T) {
+	testTools := Tools{Storage: &MemoryStorage{}}
+
+	server, err := testTools.TusServer(TusOptions{BasePath: "/files/", PartialDir: t.TempDir(), Expiration: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := tusRequest(t, server, http.MethodPost, "/files/", map[string]string{"Upload-Length": "10"}, nil).Header().Get("Location")
+	second := tusRequest(t, server, http.MethodPost, "/files/", map[string]string{"Upload-Length": "10"}, nil).Header().Get("Location")
+
+	time.Sleep(5 * time.Millisecond)
+
+	if rr := tusRequest(t, server, http.MethodHead, first, nil, nil); rr.Code != http.StatusGone {
+		t.Errorf("expected 410 for an expired upload, but got %d", rr.Code)
+	}
+
+	if err := server.PurgeExpired(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := tusRequest(t, server, http.MethodHead, second, nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected purged upload to be gone, but got %d", rr.Code)
+	}
+}
+
+func TestTusServer_LockHeldUntilRemoved(t *testing.T) {
+	testTools := Tools{Storage: &MemoryStorage{}}
+
+	server, err := testTools.TusServer(TusOptions{BasePath: "/files/", PartialDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location := tusRequest(t, server, http.MethodPost, "/files/", map[string]string{"Upload-Length": "10"}, nil).Header().Get("Location")
+	id := path.Base(location)
+
+	// a request writing to the upload holds its lock, but the offset can still be asked for
+	unlock, ok := server.lock(id)
+	if !ok {
+		t.Fatal("expected to get the lock")
+	}
+
+	if rr := tusRequest(t, server, http.MethodHead, location, nil, nil); rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("expected HEAD to be served while the lock is held, but got %d", rr.Code)
+	}
+
+	// a request removing the upload still holds its lock, which others must not get around
+	server.remove(id)
+
+	if rr := tusRequest(t, server, http.MethodDelete, location, nil, nil); rr.Code != http.StatusLocked {
+		t.Errorf("expected 423 while the lock is held, but got %d", rr.Code)
+	}
+
+	unlock()
+
+	if _, ok := server.locks.Load(id); ok {
+		t.Error("expected the lock of a removed upload to be forgotten")
+	}
+	if rr := tusRequest(t, server, http.MethodHead, location, nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 once the upload is removed, but got %d", rr.Code)
+	}
+}
@@ -7,10 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -204,7 +206,8 @@ func (t *Tools) Slugify(s string) (string, error) {
 }
 
 // DownloadsStatic File downloads a file and tries to force the browser to avoid displaying it in the browser window by setting content disposition.
-// It also alllows specification of the display name
+// It also alllows specification of the display name. pathName is served as it is, so it must not come from the client;
+// use DownloadFromDir for file names that do
 func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string) {
 
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
@@ -212,6 +215,122 @@ func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathN
 	http.ServeFile(w, r, pathName)
 }
 
+// DownloadFromFS downloads the file named fileName in fsys like DownloadStaticFile does. fileName may come from the URL:
+// names that leave the root once cleaned, absolute ones, directories and any error opening the file get a 404, so nothing
+// about the filesystem is leaked. Use ConfinedDirFS for a directory on disk
+func (t *Tools) DownloadFromFS(w http.ResponseWriter, r *http.Request, fsys fs.FS, fileName, displayName string) {
+	name := path.Clean(filepath.ToSlash(fileName))
+	if name == "." || !fs.ValidPath(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// DownloadFromDir downloads the file named fileName in the directory root, which it cannot reach outside of,
+// see DownloadFromFS and ConfinedDirFS
+func (t *Tools) DownloadFromDir(w http.ResponseWriter, r *http.Request, root, fileName, displayName string) {
+	t.DownloadFromFS(w, r, ConfinedDirFS(root), fileName, displayName)
+}
+
+// ConfinedDirFS returns a file system for the directory root, like os.DirFS, which also refuses to open files whose
+// real path, once symbolic links are followed, is outside root
+func ConfinedDirFS(root string) fs.FS {
+	return confinedDirFS(root)
+}
+
+type confinedDirFS string
+
+func (root confinedDirFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	realPath, err := root.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(realPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := root.checkOpened(name, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// checkOpened fails unless f, opened for name, is still the file name resolves to inside root. A link
+// swapped between resolving the path and opening it could otherwise have led outside root
+func (root confinedDirFS) checkOpened(name string, f *os.File) error {
+	opened, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	realPath, err := root.resolve(name)
+	if err != nil {
+		return err
+	}
+
+	current, err := os.Stat(realPath)
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(opened, current) {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+// resolve returns the real path of name under root, once symbolic links are followed, failing when it is
+// outside root
+func (root confinedDirFS) resolve(name string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(string(root))
+	if err != nil {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	realPath, err := filepath.EvalSymlinks(filepath.Join(realRoot, filepath.FromSlash(name)))
+	if err != nil {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+
+	return realPath, nil
+}
+
 // JSONResponse is the type used for sending JSON around
 type JSONResponse struct {
 	Error   bool        `json:"error"`
@@ -12,6 +12,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -227,6 +229,47 @@ func TestTools_DownloadStaticFile(t *testing.T) {
 	}
 }
 
+func TestTools_DownloadFromDir(t *testing.T) {
+	var testTool Tools
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	_ = os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	_ = os.WriteFile(filepath.Join(root, "sub", "file.txt"), []byte("inside"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("outside"), 0644)
+
+	if err := os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "escape.txt")); err != nil {
+		t.Skip("symbolic links are not supported:", err)
+	}
+
+	var downloadTests = []struct {
+		name           string
+		fileName       string
+		expectedStatus int
+	}{
+		{name: "file", fileName: "sub/file.txt", expectedStatus: http.StatusOK},
+		{name: "parent", fileName: "../secret.txt", expectedStatus: http.StatusNotFound},
+		{name: "nested parent", fileName: "sub/../../secret.txt", expectedStatus: http.StatusNotFound},
+		{name: "absolute", fileName: filepath.Join(dir, "secret.txt"), expectedStatus: http.StatusNotFound},
+		{name: "link outside", fileName: "escape.txt", expectedStatus: http.StatusNotFound},
+		{name: "directory", fileName: "sub", expectedStatus: http.StatusNotFound},
+		{name: "missing", fileName: "missing.txt", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, entry := range downloadTests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		rr := httptest.NewRecorder()
+		testTool.DownloadFromDir(rr, req, root, entry.fileName, "download.txt")
+
+		if rr.Code != entry.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", entry.name, entry.expectedStatus, rr.Code)
+		}
+		if strings.Contains(rr.Body.String(), "outside") || strings.Contains(rr.Body.String(), dir) {
+			t.Errorf("%s: the response leaks the filesystem: %q", entry.name, rr.Body.String())
+		}
+	}
+}
+
 var jsonTests = []struct {
 	name          string
 	json          string
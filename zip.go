@@ -0,0 +1,175 @@
+package toolkit
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// ZipEntry is a file to put in the archive sent by DownloadZip
+type ZipEntry struct {
+	// Key is the name of the file under the pathName given to DownloadZip, which it cannot reach outside of
+	Key string
+	// Name is the name of the file in the archive, which may include directories. When empty, the base
+	// name of Key is used
+	Name string
+}
+
+// DownloadZip sends the files in entries, found in pathName or under the pathName prefix of Storage like
+// DownloadStaticFile finds them, to the client as one zip archive named displayName. The archive is
+// streamed as each file is read rather than built first. Every file is looked up before anything is sent,
+// so a missing one, or one whose key leaves pathName, gets a 404 and the error is returned. An error once
+// the archive has started, such as the client going away, can only cut it short; it is returned as well.
+// Names in the archive cannot reach outside it, and a name used twice gets a number added, like
+// "report-1.pdf"
+func (t *Tools) DownloadZip(w http.ResponseWriter, r *http.Request, pathName string, entries []ZipEntry, displayName string) error {
+	source := t.zipFiles(pathName)
+
+	names := make([]string, len(entries))
+	used := make(map[string]bool)
+
+	for i, entry := range entries {
+		name, ok := confinedName(entry.Key)
+		if !ok {
+			http.NotFound(w, r)
+			return fmt.Errorf("zipping %s: %w", entry.Key, fs.ErrNotExist)
+		}
+		if _, err := source.stat(name); err != nil {
+			serveStorageError(w, err)
+			return fmt.Errorf("zipping %s: %w", entry.Key, err)
+		}
+
+		names[i] = entry.Name
+		if names[i] == "" {
+			names[i] = path.Base(name)
+		}
+		names[i] = uniqueZipName(zipEntryName(names[i]), used)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	t.setContentDisposition(w, displayName)
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	zw := zip.NewWriter(w)
+
+	for i, entry := range entries {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+
+		name, _ := confinedName(entry.Key)
+		if err := writeZipEntry(zw, source, name, names[i]); err != nil {
+			return fmt.Errorf("zipping %s: %w", entry.Key, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+// zipSource reads the files put in a zip archive
+type zipSource struct {
+	stat func(name string) (time.Time, error)
+	open func(name string) (io.ReadCloser, error)
+}
+
+// zipFiles reads files from pathName through ConfinedDirFS when Storage is not set, and from under the
+// pathName prefix of Storage otherwise
+func (t *Tools) zipFiles(pathName string) zipSource {
+	if t.Storage == nil {
+		fsys := ConfinedDirFS(pathName)
+		return zipSource{
+			stat: func(name string) (time.Time, error) {
+				// whatever keeps a file from being read, such as a link leaving pathName, is reported as
+				// the file not existing
+				info, err := fs.Stat(fsys, name)
+				if err != nil || !info.Mode().IsRegular() {
+					return time.Time{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+				}
+				return info.ModTime(), nil
+			},
+			open: func(name string) (io.ReadCloser, error) {
+				return fsys.Open(name)
+			},
+		}
+	}
+
+	return zipSource{
+		stat: func(name string) (time.Time, error) {
+			info, err := t.Storage.Stat(storageKey(pathName, name))
+			return info.ModTime, err
+		},
+		open: func(name string) (io.ReadCloser, error) {
+			return t.Storage.Get(storageKey(pathName, name))
+		},
+	}
+}
+
+func writeZipEntry(zw *zip.Writer, source zipSource, name, zipName string) error {
+	modTime, err := source.stat(name)
+	if err != nil {
+		return err
+	}
+
+	obj, err := source.open(name)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	header := &zip.FileHeader{Name: zipName, Method: zip.Deflate, Modified: modTime}
+	if isCompressed(zipName) {
+		// deflating files that are already compressed only costs time
+		header.Method = zip.Store
+	}
+
+	fw, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fw, obj)
+	return err
+}
+
+// zipEntryName turns name into a relative path with forward slashes that stays inside the archive
+func zipEntryName(name string) string {
+	name = path.Clean("/" + strings.ReplaceAll(name, `\`, "/"))
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		return "file"
+	}
+	return name
+}
+
+// uniqueZipName returns name, or name with a number added when it is already in used, and marks it used
+func uniqueZipName(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for i := 1; used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+
+	used[candidate] = true
+	return candidate
+}
+
+// isCompressed reports whether name has the extension of a format that is already compressed
+func isCompressed(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".zip", ".gz", ".tgz", ".bz2", ".xz", ".7z", ".rar",
+		".mp3", ".mp4", ".mov", ".avi", ".mkv", ".pdf", ".docx", ".xlsx", ".pptx":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package toolkit
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTools_DownloadZip(t *testing.T) {
+	store := &MemoryStorage{}
+	testTools := Tools{Storage: store}
+
+	_, _ = store.Put("uploads/a.txt", strings.NewReader("first file"))
+	_, _ = store.Put("uploads/b.txt", strings.NewReader("second file"))
+	_, _ = store.Put("other/b.txt", strings.NewReader("third file"))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	err := testTools.DownloadZip(rr, req, "", []ZipEntry{
+		{Key: "uploads/a.txt", Name: "docs/first.txt"},
+		{Key: "uploads/b.txt"},
+		{Key: "other/b.txt"},
+		{Key: "uploads/a.txt", Name: "../../etc/passwd"},
+	}, "files.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Header().Get("Content-Type") != "application/zip" || rr.Header().Get("Content-Disposition") != `attachment; filename="files.zip"` {
+		t.Errorf("wrong headers: %v", rr.Header())
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal("the response is not a zip archive:", err)
+	}
+
+	expected := map[string]string{
+		"docs/first.txt": "first file",
+		"b.txt":          "second file",
+		"b-1.txt":        "third file",
+		"etc/passwd":     "first file",
+	}
+	if len(zr.File) != len(expected) {
+		t.Fatalf("expected %d files, but got %d", len(expected), len(zr.File))
+	}
+
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+
+		if expected[f.Name] != string(content) {
+			t.Errorf("%s: expected %q, but got %q", f.Name, expected[f.Name], content)
+		}
+	}
+
+	// a missing file, or one outside pathName, is found before anything is sent
+	for _, key := range []string{"missing.txt", "../other/b.txt", "/uploads/a.txt"} {
+		rr = httptest.NewRecorder()
+		err = testTools.DownloadZip(rr, req, "uploads", []ZipEntry{{Key: "a.txt"}, {Key: key}}, "files.zip")
+		if err == nil || rr.Code != http.StatusNotFound {
+			t.Errorf("%s: expected a 404 and an error, but got %d and %v", key, rr.Code, err)
+		}
+	}
+}
+
+func TestTools_DownloadZipLocal(t *testing.T) {
+	var testTools Tools
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	_ = os.MkdirAll(root, 0755)
+	_ = os.WriteFile(filepath.Join(root, "a.txt"), []byte("inside"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("outside"), 0644)
+	symlinks := os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "escape.txt")) == nil
+
+	req := httptest.NewRequest("GET", "/", nil)
+
+	rr := httptest.NewRecorder()
+	if err := testTools.DownloadZip(rr, req, root, []ZipEntry{{Key: "a.txt"}}, "files.zip"); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil || len(zr.File) != 1 || zr.File[0].Name != "a.txt" {
+		t.Fatalf("wrong archive: %v", err)
+	}
+
+	keys := []string{"../secret.txt", filepath.Join(dir, "secret.txt")}
+	if symlinks {
+		keys = append(keys, "escape.txt")
+	}
+
+	for _, key := range keys {
+		rr = httptest.NewRecorder()
+		err := testTools.DownloadZip(rr, req, root, []ZipEntry{{Key: key}}, "files.zip")
+		if err == nil || rr.Code != http.StatusNotFound || strings.Contains(rr.Body.String(), "outside") {
+			t.Errorf("%s: expected a 404 and an error, but got %d and %v", key, rr.Code, err)
+		}
+	}
+}